@@ -0,0 +1,21 @@
+package main
+
+import "time"
+
+// Clock tells the time. It allows time-dependent components such as the
+// Scheduler to be driven by tests.
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+// systemClock is the Clock of the operating system.
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (systemClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
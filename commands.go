@@ -0,0 +1,101 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+)
+
+// commands lists the subcommands that can be given to the server's binary
+// instead of starting the server.
+var commands = map[string]func(db Database, args []string) error{
+	"replay": replayCommand,
+	"tune":   tuneCommand,
+}
+
+// replayCommand replays the history stored in the database against another
+// configuration and prints a summary of what would have happened.
+//
+// Usage: boursiere replay [-strategy name] [beers.csv]
+func replayCommand(db Database, args []string) error {
+	flags := flag.NewFlagSet("replay", flag.ExitOnError)
+	name := flags.String("strategy", "default", "pricing strategy to use")
+	flags.Parse(args)
+
+	strategy, ok := strategies[*name]
+	if !ok {
+		return fmt.Errorf("unknown strategy %q", *name)
+	}
+
+	beers, err := db.Beers.All()
+	if err != nil {
+		return err
+	}
+
+	if flags.NArg() > 0 {
+		file, err := os.Open(flags.Arg(0))
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+
+		configs, err := LoadBeersFromCSV(file)
+		if err != nil {
+			return err
+		}
+
+		ApplyConfig(beers, configs)
+	}
+
+	history, err := db.Beers.History()
+	if err != nil {
+		return err
+	}
+
+	printReplay(os.Stdout, ReplayHistory(beers, history, strategy))
+	return nil
+}
+
+// printReplay writes a replay as a human-readable table.
+func printReplay(w io.Writer, replay Replay) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "Beer\tActual\tSimulated\tDifference\tSimulated prices\t")
+	for _, b := range replay.Beers {
+		fmt.Fprintf(tw, "%s\t%.2f\t%.2f\t%+.2f\t%.2f\t\n", b.Name, b.ActualProfit, b.SimulatedProfit, b.ProfitDifference, b.SimulatedPrices)
+	}
+	fmt.Fprintf(tw, "Total\t%.2f\t%.2f\t%+.2f\t\t\n", replay.ActualProfit, replay.SimulatedProfit, replay.ProfitDifference)
+	tw.Flush()
+}
+
+// tuneCommand suggests coefficients for a beer catalogue and prints it back as
+// CSV, ready to be uploaded.
+//
+// Usage: boursiere tune [-margin m | -volatility v] [-periods n] beers.csv
+func tuneCommand(db Database, args []string) error {
+	flags := flag.NewFlagSet("tune", flag.ExitOnError)
+	margin := flags.Float64("margin", 0, "target profit margin (e.g. 0.2)")
+	volatility := flags.Float64("volatility", 0, "target price change per period (e.g. 0.05)")
+	periods := flags.Int("periods", 24, "number of periods of the event")
+	flags.Parse(args)
+
+	if flags.NArg() != 1 || *periods < 1 || *margin < 0 || *volatility < 0 || (*margin == 0) == (*volatility == 0) {
+		flags.Usage()
+		return errors.New("a catalogue and exactly one target are required")
+	}
+
+	data, err := os.ReadFile(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	beers, expected, err := loadTuneCSV(data)
+	if err != nil {
+		return err
+	}
+
+	target := TuneTarget{Margin: *margin, Volatility: *volatility}
+	return MarshalCSV(os.Stdout, TuneCoefs(beers, expected, *periods, target))
+}
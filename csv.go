@@ -0,0 +1,163 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// csvField is a struct field that can be read from or written to a CSV column.
+type csvField struct {
+	title string
+	index int
+}
+
+// csvFields lists the fields of a struct type, in order, along with their
+// column title. It takes the `csv` struct tag into account and omits fields
+// tagged with `csv:"-"`.
+func csvFields(t reflect.Type) []csvField {
+	fields := []csvField{}
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		title := field.Tag.Get("csv")
+		if title == "-" {
+			continue
+		}
+		if title == "" {
+			title = field.Name
+		}
+		fields = append(fields, csvField{title, i})
+	}
+
+	return fields
+}
+
+// UnmarshalCSV parses CSV data and stores the result in the slice of structs
+// pointed to by v. It mimics Unmarshal from the standard library.
+//
+// The first row is interpreted as column names and takes the `csv` struct tag
+// into account. Missing columns are ignored and `csv:"-"` tags are omitted.
+//
+// For columns of type float64, "," are replaced with "." to handle French
+// decimal commas. Furthermore, trailling spaces (" ") and euro symbols ("€")
+// are removed.
+func UnmarshalCSV(source io.Reader, v interface{}) error {
+	slice := reflect.ValueOf(v).Elem()
+	elemType := slice.Type().Elem()
+
+	r := csv.NewReader(source)
+	titles, err := r.Read()
+	if err != nil {
+		return err
+	}
+
+	records, err := r.ReadAll()
+	if err != nil {
+		return err
+	}
+
+	mapping := map[string]int{}
+	for i, title := range titles {
+		mapping[title] = i
+	}
+
+	fields := csvFields(elemType)
+	for _, record := range records {
+		elem := reflect.New(elemType).Elem()
+
+		for _, field := range fields {
+			i, ok := mapping[field.title]
+			if !ok {
+				continue
+			}
+
+			s := record[i]
+			f := elem.Field(field.index)
+
+			switch f.Kind() {
+			case reflect.Int:
+				v, err := strconv.ParseInt(s, 10, 0)
+				if err != nil {
+					return err
+				}
+				f.SetInt(v)
+
+			case reflect.Uint:
+				v, err := strconv.ParseUint(s, 10, 0)
+				if err != nil {
+					return err
+				}
+				f.SetUint(v)
+
+			case reflect.Float64:
+				s = strings.TrimRight(s, " €")
+				s = strings.ReplaceAll(s, ",", ".")
+				v, err := strconv.ParseFloat(s, 64)
+				if err != nil {
+					return err
+				}
+				f.SetFloat(v)
+
+			case reflect.String:
+				f.SetString(s)
+
+			default:
+				panic(fmt.Sprintf("unmanaged type %v for field %v", f.Type(), elemType.Field(field.index).Name))
+			}
+		}
+
+		slice.Set(reflect.Append(slice, elem))
+	}
+
+	return nil
+}
+
+// MarshalCSV writes a slice of structs as CSV data that can be read back with
+// UnmarshalCSV. Floats are written with a decimal point.
+func MarshalCSV(w io.Writer, v interface{}) error {
+	slice := reflect.ValueOf(v)
+	fields := csvFields(slice.Type().Elem())
+
+	cw := csv.NewWriter(w)
+	record := make([]string, len(fields))
+	for i, field := range fields {
+		record[i] = field.title
+	}
+	if err := cw.Write(record); err != nil {
+		return err
+	}
+
+	for i := 0; i < slice.Len(); i++ {
+		elem := slice.Index(i)
+		for j, field := range fields {
+			f := elem.Field(field.index)
+
+			switch f.Kind() {
+			case reflect.Int:
+				record[j] = strconv.FormatInt(f.Int(), 10)
+
+			case reflect.Uint:
+				record[j] = strconv.FormatUint(f.Uint(), 10)
+
+			case reflect.Float64:
+				record[j] = strconv.FormatFloat(f.Float(), 'f', -1, 64)
+
+			case reflect.String:
+				record[j] = f.String()
+
+			default:
+				panic(fmt.Sprintf("unmanaged type %v for field %v", f.Type(), slice.Type().Elem().Field(field.index).Name))
+			}
+		}
+
+		if err := cw.Write(record); err != nil {
+			return err
+		}
+	}
+
+	cw.Flush()
+	return cw.Error()
+}
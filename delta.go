@@ -0,0 +1,139 @@
+package main
+
+import (
+	"encoding/json"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+)
+
+// BeerDeltas keeps track of the beers that were last sent to clients, so that
+// only what changed is broadcasted.
+//
+// It is meant to be used as a broker's transform function (see
+// NewMemoryBroker): "beers" events, which contain all beers (see BeersEvent),
+// are turned into "update" events. Update events only contain the changed
+// fields of changed beers, along with their ID. Removed beers are sent as
+// {"id": …, "removed": true}.
+//
+// The version of the state is the ID of the "beers" event it comes from, which
+// is shared by all server instances (see RelayBroker), or 0 for the initial
+// state. Updates carry their version along with the previous one, which the
+// client must have to apply them. Otherwise, it missed an update or comes from
+// another instance whose previous state differs, and it should ask for a new
+// snapshot. Since the initial state of each instance differs, clients that
+// resume on another instance from before it started receive a snapshot
+// instead (see RelayBroker).
+type BeerDeltas struct {
+	mu      sync.Mutex
+	version uint64
+	items   []Item
+	fields  map[uint]map[string]json.RawMessage
+}
+
+// NewBeerDeltas creates a tracker whose initial state, version 0, is the
+// given beers.
+func NewBeerDeltas(beers []Beer) *BeerDeltas {
+	items := BeersEvent(beers).Items
+	return &BeerDeltas{items: items, fields: itemFields(items)}
+}
+
+// BeersEvent creates a "beers" event made of one item per beer.
+func BeersEvent(beers []Beer) Event {
+	items := make([]Item, len(beers))
+	for i, beer := range beers {
+		items[i] = NewItem(beer.ID, beer.BarID, beer)
+	}
+	return NewItemEvent("beers", items)
+}
+
+// Snapshot returns a "snapshot" event made of the current state, as a whole.
+func (d *BeerDeltas) Snapshot() Event {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	e := NewItemEvent("snapshot", append([]Item{}, d.items...))
+	e.Versioned = true
+	e.Version = d.version
+	return e
+}
+
+// Beers returns the current state.
+func (d *BeerDeltas) Beers() []Beer {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	beers := make([]Beer, len(d.items))
+	for i, item := range d.items {
+		if err := json.Unmarshal([]byte(item.Data), &beers[i]); err != nil {
+			panic(err)
+		}
+	}
+	return beers
+}
+
+// Convert replaces the current state with the beers of a "beers" event and
+// returns what changed as an "update" event. It returns false if nothing
+// changed. Other events are returned as is.
+func (d *BeerDeltas) Convert(e Event) (Event, bool) {
+	if e.Type != "beers" {
+		return e, true
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	fields := itemFields(e.Items)
+	items := []Item{}
+	for _, item := range e.Items {
+		old, ok := d.fields[item.BeerID]
+		if !ok {
+			items = append(items, item)
+			continue
+		}
+
+		diff := map[string]json.RawMessage{}
+		for name, value := range fields[item.BeerID] {
+			if string(old[name]) != string(value) {
+				diff[name] = value
+			}
+		}
+
+		if len(diff) > 0 {
+			diff["id"] = fields[item.BeerID]["id"]
+			items = append(items, NewItem(item.BeerID, item.BarID, diff))
+		}
+	}
+
+	for _, item := range d.items {
+		if _, ok := fields[item.BeerID]; !ok {
+			items = append(items, NewItem(item.BeerID, item.BarID, gin.H{"id": item.BeerID, "removed": true}))
+		}
+	}
+
+	d.items, d.fields = e.Items, fields
+	if len(items) == 0 {
+		return e, false
+	}
+
+	update := NewItemEvent("update", items)
+	update.ID = e.ID
+	update.Versioned = true
+	update.Version = e.ID
+	update.Previous = d.version
+	d.version = e.ID
+	return update, true
+}
+
+// itemFields returns the JSON fields of every item, by beer ID.
+func itemFields(items []Item) map[uint]map[string]json.RawMessage {
+	fields := map[uint]map[string]json.RawMessage{}
+	for _, item := range items {
+		var f map[string]json.RawMessage
+		if err := json.Unmarshal([]byte(item.Data), &f); err != nil {
+			panic(err)
+		}
+		fields[item.BeerID] = f
+	}
+	return fields
+}
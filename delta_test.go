@@ -0,0 +1,55 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestBeerDeltas(t *testing.T) {
+	beers := []Beer{
+		{ID: 1, BarID: 1, Name: "Bush", SellingPrice: 1.2},
+		{ID: 2, BarID: 2, Name: "TK", SellingPrice: 2},
+	}
+	d := NewBeerDeltas(beers)
+
+	want := `{"version":0,"beers":[` + marshal(beers[0]) + "," + marshal(beers[1]) + "]}"
+	if got := d.Snapshot().Payload(); got != want {
+		t.Errorf("d.Snapshot() = %v; got %v", want, got)
+	}
+
+	beers[0].SellingPrice = 1.3
+	beers[1] = Beer{ID: 3, BarID: 2, Name: "Kwak"}
+	e := BeersEvent(beers)
+	e.ID = 7
+	got, ok := d.Convert(e)
+
+	want = `{"version":7,"previous":0,"beers":[{"id":1,"sellingPrice":1.3},` + marshal(beers[1]) + `,{"id":2,"removed":true}]}`
+	if !ok || got.Type != "update" || got.Payload() != want {
+		t.Errorf("d.Convert() = update %v; got %v %v", want, got.Type, got.Payload())
+	}
+
+	// Nothing changed, nothing is sent.
+	if got, ok := d.Convert(BeersEvent(beers)); ok {
+		t.Errorf("d.Convert() should drop the event; got %v", got)
+	}
+
+	// Other events are left untouched.
+	notice := NewEvent("notice", "hello")
+	if got, ok := d.Convert(notice); !ok || got.Data != notice.Data {
+		t.Errorf("d.Convert() = %v; got %v", notice, got)
+	}
+
+	if got := d.Snapshot(); got.Version != 7 || len(got.Items) != 2 {
+		t.Errorf("d.Snapshot() = {version: 7, 2 beers}; got %v", got)
+	}
+
+	// The next update follows the version it was computed from.
+	beers[0].SellingPrice = 1.4
+	e = BeersEvent(beers)
+	e.ID = 9
+	if got, ok := d.Convert(e); !ok || got.Version != 9 || got.Previous != 7 {
+		t.Errorf("d.Convert() = {version: 9, previous: 7}; got %+v", got)
+	}
+	if got := d.Beers(); len(got) != 2 || got[0].SellingPrice != 1.4 || got[1].Name != "Kwak" {
+		t.Errorf("d.Beers() = [Bush at 1.4, Kwak]; got %v", got)
+	}
+}
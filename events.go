@@ -2,29 +2,343 @@ package main
 
 import (
 	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
+	"github.com/gin-contrib/sse"
 	"github.com/gin-gonic/gin"
 )
 
+const (
+	// backlogSize is the number of past events a Broker keeps to let
+	// reconnecting clients catch up.
+	backlogSize = 128
+
+	// heartbeatPeriod is the time between two heartbeats, which prevent
+	// proxies from closing idle connections.
+	heartbeatPeriod = 15 * time.Second
+
+	// queueSize is the number of events that can wait for a client to read
+	// them. Beyond that, the client is considered too slow.
+	queueSize = 32
+)
+
+// SlowClientPolicy tells a Broker what to do with clients that don't read
+// their events fast enough.
+type SlowClientPolicy int
+
+const (
+	// Disconnect closes the connection of slow clients. They will then
+	// reconnect and catch up using their last event ID.
+	Disconnect SlowClientPolicy = iota
+
+	// DropEvents drops the events that don't fit in a slow client's queue.
+	DropEvents
+)
+
+// BrokerStats counts what happened to a Broker's events.
+type BrokerStats struct {
+	Clients uint64 `json:"clients"`
+	Sent    uint64 `json:"sent"`
+	Dropped uint64 `json:"dropped"`
+	Evicted uint64 `json:"evicted"`
+}
+
+// Event is a message sent to clients. Its ID increases with every broadcast,
+// starting from 1. Its type is used as the SSE event name and its data is
+// JSON.
+//
+// Events about beers are made of items instead, one per beer, so that they
+// can be filtered. They are sent as a JSON array of the items' data or, if
+// they are versioned (see BeerDeltas), as {"version": …, "beers": […]}, with
+// the previous version for updates.
+//
+// Retry, in milliseconds, tells SSE clients how long to wait before
+// reconnecting.
+type Event struct {
+	ID        uint64
+	Type      string
+	Data      string
+	Items     []Item
+	Versioned bool
+	Version   uint64
+	Previous  uint64
+	Retry     uint
+}
+
+// Item is the part of an event that is about a single beer.
+type Item struct {
+	BeerID uint
+	BarID  uint
+	Data   string
+}
+
+// Payload returns the JSON data of an event, as it is sent to clients.
+func (e Event) Payload() string {
+	if e.Items == nil {
+		return e.Data
+	}
+
+	parts := make([]string, len(e.Items))
+	for i, item := range e.Items {
+		parts[i] = item.Data
+	}
+	items := "[" + strings.Join(parts, ",") + "]"
+
+	if !e.Versioned {
+		return items
+	}
+
+	versions := `{"version":` + strconv.FormatUint(e.Version, 10)
+	if e.Type == "update" {
+		versions += `,"previous":` + strconv.FormatUint(e.Previous, 10)
+	}
+	return versions + `,"beers":` + items + "}"
+}
+
+// NewEvent creates an event whose data is marshalled into JSON.
+func NewEvent(eventType string, data interface{}) Event {
+	return Event{Type: eventType, Data: marshal(data)}
+}
+
+// NewItemEvent creates an event made of items.
+func NewItemEvent(eventType string, items []Item) Event {
+	return Event{Type: eventType, Items: items}
+}
+
+// NewItem creates an item whose data is marshalled into JSON.
+func NewItem(beerID, barID uint, data interface{}) Item {
+	return Item{BeerID: beerID, BarID: barID, Data: marshal(data)}
+}
+
+// marshal returns the JSON encoding of data.
+func marshal(data interface{}) string {
+	msg, err := json.Marshal(data)
+	if err != nil {
+		panic(err)
+	}
+
+	return string(msg)
+}
+
+// Filter selects the events a client is interested in. A nil set means
+// everything.
+//
+// An item matches if its bar or its beer is in the sets. Events whose items
+// don't match are reduced to the matching items, or not sent at all.
+// Snapshots are always sent, whatever their type.
+//
+// Unlike the other sets, Allowed is not chosen by clients: items of other bars
+// never match, whatever they asked for.
+type Filter struct {
+	Bars    map[uint]bool
+	Beers   map[uint]bool
+	Types   map[string]bool
+	Allowed map[uint]bool
+}
+
+// ParseFilter creates a filter from the "bar", "beer" and "types" query
+// parameters of a request. They can be repeated or contain comma-separated
+// values, e.g. "?bar=1,2&types=update,order".
+//
+// Requests authenticated with an API key restricted to some bars (see auth)
+// only get the items of these bars.
+func ParseFilter(c *gin.Context) (Filter, error) {
+	var f Filter
+	var err error
+
+	if key, ok := c.Get("apiKey"); ok && len(key.(APIKey).Bars) > 0 {
+		f.Allowed = map[uint]bool{}
+		for _, bar := range key.(APIKey).Bars {
+			f.Allowed[bar] = true
+		}
+	}
+
+	if f.Bars, err = parseIDs(c.QueryArray("bar")); err != nil {
+		return f, err
+	}
+	if f.Beers, err = parseIDs(c.QueryArray("beer")); err != nil {
+		return f, err
+	}
+	if values := splitValues(c.QueryArray("types")); values != nil {
+		f.Types = map[string]bool{}
+		for _, v := range values {
+			f.Types[v] = true
+		}
+	}
+
+	return f, nil
+}
+
+// parseIDs parses a set of comma-separated IDs.
+func parseIDs(params []string) (map[uint]bool, error) {
+	values := splitValues(params)
+	if values == nil {
+		return nil, nil
+	}
+
+	ids := map[uint]bool{}
+	for _, v := range values {
+		id, err := strconv.ParseUint(v, 10, 0)
+		if err != nil {
+			return nil, err
+		}
+		ids[uint(id)] = true
+	}
+
+	return ids, nil
+}
+
+// splitValues splits comma-separated query parameters. It returns nil if
+// there are no values.
+func splitValues(params []string) []string {
+	var values []string
+	for _, p := range params {
+		for _, v := range strings.Split(p, ",") {
+			if v != "" {
+				values = append(values, v)
+			}
+		}
+	}
+	return values
+}
+
+// Apply returns the part of an event that matches the filter. It returns
+// false if nothing matches, except for versioned events which are always sent
+// (possibly empty) so that clients can keep track of versions.
+func (f Filter) Apply(e Event) (Event, bool) {
+	if e.Type != "snapshot" && f.Types != nil && !f.Types[e.Type] {
+		return e, false
+	}
+
+	if len(e.Items) == 0 || (f.Bars == nil && f.Beers == nil && f.Allowed == nil) {
+		return e, true
+	}
+
+	all := f.Bars == nil && f.Beers == nil
+	items := []Item{}
+	for _, item := range e.Items {
+		if f.Allowed != nil && !f.Allowed[item.BarID] {
+			continue
+		}
+		if all || f.Bars[item.BarID] || f.Beers[item.BeerID] {
+			items = append(items, item)
+		}
+	}
+
+	e.Items = items
+	return e, len(items) > 0 || e.Versioned
+}
+
 // Broker represents a server-sent events (SSE) route.
 //
-// Once created with NewBroker, use ServeHTTP as a route handler and Broadcast
-// to send events.
-type Broker struct {
-	clients   map[chan string]struct{}
-	openChan  chan chan string
-	closeChan chan chan string
-	sendChan  chan string
+// Use ServeHTTP as a route handler and Broadcast to send events. Brokers are
+// either in-memory (see MemoryBroker) or relayed between server instances (see
+// RelayBroker).
+type Broker interface {
+	ServeHTTP(c *gin.Context)
+	Subscribe(lastID uint64, filter Filter) (chan Event, resume)
+	Unsubscribe(c chan Event)
+	Broadcast(e Event)
+	Close(retry time.Duration)
+	Stats() BrokerStats
+	catchUp(r resume, filter Filter) ([]Event, error)
+	lastEventID() uint64
+}
+
+// BrokerFunc creates a broker for a channel. See NewMemoryBroker for the
+// other parameters.
+type BrokerFunc func(channel string, snapshot func() (Event, error), transform func(e Event) (Event, bool)) (Broker, error)
+
+// MemoryBrokers returns a BrokerFunc that creates in-memory brokers.
+func MemoryBrokers(policy SlowClientPolicy) BrokerFunc {
+	return func(channel string, snapshot func() (Event, error), transform func(e Event) (Event, bool)) (Broker, error) {
+		return NewMemoryBroker(snapshot, transform, policy), nil
+	}
+}
+
+// MemoryBroker is a Broker whose events only reach the clients of the current
+// server instance.
+//
+// New clients first receive a "snapshot" event describing the current state.
+// Every event has an ID and the last ones are kept in a backlog, so that a
+// client that reconnects with a Last-Event-ID header receives what it missed.
+// If the missed events are not available anymore, it receives a snapshot
+// instead.
+//
+// Broadcasting never waits for clients: each of them has its own queue and
+// the ones that fall behind are handled according to the broker's policy.
+type MemoryBroker struct {
+	clients   map[chan Event]Filter
+	openChan  chan subscription
+	closeChan chan chan Event
+	idChan    chan chan uint64
+	sendChan  chan Event
+	stopChan  chan time.Duration
+	done      chan struct{}
+	snapshot  func() (Event, error)
+	transform func(e Event) (Event, bool)
+	policy    SlowClientPolicy
+	backlog   []Event
+	trimmedID uint64
+	lastID    uint64
+	statsMu   sync.Mutex
+	stats     BrokerStats
+}
+
+// subscription is a request to register a new client. The broker answers it
+// with the events the client missed.
+type subscription struct {
+	c      chan Event
+	lastID uint64
+	filter Filter
+	reply  chan resume
+}
+
+// resume tells a new client what it missed since its last event. If ok is
+// false, missed events are not available anymore and a snapshot should be
+// sent with the given ID.
+type resume struct {
+	missed []Event
+	ok     bool
+	lastID uint64
+}
+
+// NewMemoryBroker creates a ready-to-use broker. It starts a new goroutine
+// that handles incoming messages and connections.
+//
+// The snapshot function returns the current state as a whole. It is sent to
+// new clients and to clients that cannot catch up otherwise, as a "snapshot"
+// event.
+//
+// If not nil, the transform function is applied to every broadcasted event,
+// in order, before it is sent. Events for which it returns false are dropped.
+func NewMemoryBroker(snapshot func() (Event, error), transform func(e Event) (Event, bool), policy SlowClientPolicy) *MemoryBroker {
+	return newMemoryBroker(0, snapshot, transform, policy)
 }
 
-// NewBroker creates a ready-to-use broker. It starts a new goroutine that
-// handles incoming messages and connections.
-func NewBroker() Broker {
-	b := Broker{
-		clients:   make(map[chan string]struct{}),
-		openChan:  make(chan chan string),
-		closeChan: make(chan chan string),
-		sendChan:  make(chan string, 4),
+// newMemoryBroker creates a broker whose events follow startID. Clients
+// resuming from startID or before receive a snapshot, since the broker doesn't
+// know what they missed.
+func newMemoryBroker(startID uint64, snapshot func() (Event, error), transform func(e Event) (Event, bool), policy SlowClientPolicy) *MemoryBroker {
+	b := &MemoryBroker{
+		clients:   make(map[chan Event]Filter),
+		openChan:  make(chan subscription),
+		closeChan: make(chan chan Event),
+		idChan:    make(chan chan uint64),
+		sendChan:  make(chan Event, queueSize),
+		stopChan:  make(chan time.Duration),
+		done:      make(chan struct{}),
+		snapshot:  snapshot,
+		transform: transform,
+		policy:    policy,
+		lastID:    startID,
+	}
+	if startID > 0 {
+		b.trimmedID = startID + 1
 	}
 
 	go b.listen()
@@ -32,19 +346,46 @@ func NewBroker() Broker {
 }
 
 // ServeHTTP is an SSE handler function that sends any broadcasted message.
-func (b *Broker) ServeHTTP(c *gin.Context) {
-	msgs := b.Subscribe()
+// Clients can choose which events they receive with query parameters (see
+// ParseFilter).
+func (b *MemoryBroker) ServeHTTP(c *gin.Context) {
+	filter, err := ParseFilter(c)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "bad_request"})
+		return
+	}
+
+	lastID, _ := strconv.ParseUint(c.GetHeader("Last-Event-ID"), 10, 64)
+	msgs, resume := b.Subscribe(lastID, filter)
 	defer b.Unsubscribe(msgs)
 
 	w := c.Writer
 	closed := w.CloseNotify()
+	heartbeat := time.NewTicker(heartbeatPeriod)
+	defer heartbeat.Stop()
+
+	missed, err := b.catchUp(resume, filter)
+	if err != nil {
+		panic(err)
+	}
+
+	for _, e := range missed {
+		render(c, e)
+	}
+	w.Flush()
 
 	// Don't use c.Stream(): it would block the connection until a new message
 	// is received whereas we should listen for disconnection simultaneously.
 	for {
 		select {
-		case msg := <-msgs:
-			c.SSEvent("", msg)
+		case e, ok := <-msgs:
+			if !ok {
+				return // evicted
+			}
+			render(c, e)
+			w.Flush()
+		case <-heartbeat.C:
+			w.WriteString(": heartbeat\n\n")
 			w.Flush()
 		case <-closed:
 			return
@@ -52,67 +393,219 @@ func (b *Broker) ServeHTTP(c *gin.Context) {
 	}
 }
 
+// catchUp returns the events a new client should receive before anything
+// else: what it missed or, if that is not available, a snapshot.
+func (b *MemoryBroker) catchUp(r resume, filter Filter) ([]Event, error) {
+	if r.ok {
+		return r.missed, nil
+	}
+
+	snapshot, err := b.snapshot()
+	if err != nil {
+		return nil, err
+	}
+
+	snapshot.ID = r.lastID
+	snapshot.Type = "snapshot"
+	snapshot, _ = filter.Apply(snapshot)
+	return []Event{snapshot}, nil
+}
+
+// render writes an event to an SSE stream.
+func render(c *gin.Context, e Event) {
+	c.Render(-1, sse.Event{
+		Id:    strconv.FormatUint(e.ID, 10),
+		Event: e.Type,
+		Data:  e.Payload(),
+		Retry: e.Retry,
+	})
+}
+
 // Subscribe creates, registers and returns a new channel that can be used to
-// receive incoming messages.
-func (b *Broker) Subscribe() chan string {
-	c := make(chan string)
-	b.openChan <- c
-	return c
+// receive incoming messages matching a filter. It also tells what the client
+// missed since lastID (zero if the client is new).
+func (b *MemoryBroker) Subscribe(lastID uint64, filter Filter) (chan Event, resume) {
+	c := make(chan Event, queueSize)
+	reply := make(chan resume, 1)
+	select {
+	case b.openChan <- subscription{c, lastID, filter, reply}:
+		return c, <-reply
+	case <-b.done:
+		close(c)
+		return c, resume{}
+	}
 }
 
 // Unsubscribe closes a channel that was created with Subscribe. It is
-// mandatory to unsubscribe when a client disconnects.
-func (b *Broker) Unsubscribe(c chan string) {
-	b.closeChan <- c
+// mandatory to unsubscribe when a client disconnects, even if the channel was
+// already closed by the broker.
+func (b *MemoryBroker) Unsubscribe(c chan Event) {
+	select {
+	case b.closeChan <- c:
+	case <-b.done:
+	}
 }
 
-// Broadcast sends a message to every connected client. The sent event is
-// marshalled into JSON beforehand.
-func (b *Broker) Broadcast(event interface{}) {
-	msg, err := json.Marshal(event)
-	if err != nil {
-		panic(err)
+// lastEventID returns the ID of the last event broadcasted to clients, which
+// is what a snapshot taken now should be stamped with.
+func (b *MemoryBroker) lastEventID() uint64 {
+	reply := make(chan uint64, 1)
+	select {
+	case b.idChan <- reply:
+		return <-reply
+	case <-b.done:
+		return 0
 	}
+}
 
-	b.sendChan <- string(msg)
+// Broadcast sends an event to every connected client whose filter matches.
+// Its ID is set by the broker.
+//
+// It doesn't wait for clients to receive the event. Events broadcasted after
+// Close are dropped.
+func (b *MemoryBroker) Broadcast(e Event) {
+	select {
+	case b.sendChan <- e:
+	case <-b.done:
+	}
+}
+
+// Close sends a "shutdown" event to every client, telling them to reconnect
+// after retry, and disconnects them. The broker cannot be used anymore
+// afterwards.
+func (b *MemoryBroker) Close(retry time.Duration) {
+	select {
+	case b.stopChan <- retry:
+	case <-b.done:
+	}
+	<-b.done
+}
+
+// Stats returns a copy of the broker's counters.
+func (b *MemoryBroker) Stats() BrokerStats {
+	b.statsMu.Lock()
+	defer b.statsMu.Unlock()
+	return b.stats
 }
 
 // listen handles client's connection and disconnection, and broadcasts any
-// incoming message to all clients.
-func (b *Broker) listen() {
+// incoming message to all clients, until the broker is closed.
+func (b *MemoryBroker) listen() {
 	for {
 		select {
-		case c := <-b.openChan:
-			b.clients[c] = struct{}{}
+		case s := <-b.openChan:
+			b.clients[s.c] = s.filter
+			b.count(func(stats *BrokerStats) { stats.Clients++ })
+			s.reply <- b.since(s.lastID, s.filter)
 
 		case c := <-b.closeChan:
-			close(c)
-			delete(b.clients, c)
+			b.remove(c)
+
+		case reply := <-b.idChan:
+			reply <- b.lastID
+
+		case e := <-b.sendChan:
+			// Relayed events are already numbered.
+			if e.ID == 0 {
+				e.ID = b.lastID + 1
+			}
+			b.lastID = e.ID
+
+			if b.transform != nil {
+				var ok bool
+				if e, ok = b.transform(e); !ok {
+					continue
+				}
+			}
+
+			b.backlog = append(b.backlog, e)
+			if len(b.backlog) > backlogSize {
+				b.trimmedID = b.backlog[0].ID
+				b.backlog = b.backlog[1:]
+			}
+
+			for client, filter := range b.clients {
+				if e, ok := filter.Apply(e); ok {
+					b.send(client, e)
+				}
+			}
+
+		case retry := <-b.stopChan:
+			b.lastID++
+			e := NewEvent("shutdown", gin.H{"retry": retry.Milliseconds()})
+			e.ID = b.lastID
+			e.Retry = uint(retry.Milliseconds())
 
-		case msg := <-b.sendChan:
 			for client := range b.clients {
-				b.send(client, msg)
+				b.send(client, e)
+				b.remove(client)
 			}
+
+			close(b.done)
+			return
 		}
 	}
 }
 
-// send writes a message to a client's channel. It returns when the message is
-// sent or if the client disconnected.
-func (b *Broker) send(client chan string, msg string) {
-	// A client could disconnect while we're trying to send a message.
-	// So we MUST listen to the closeChan to avoid a (sneaky) deadlock!
-	for {
-		select {
-		case client <- msg:
-			return
+// since returns the events matching a filter that were broadcasted after
+// lastID, if they are still in the backlog.
+func (b *MemoryBroker) since(lastID uint64, filter Filter) resume {
+	if lastID == 0 {
+		return resume{ok: false, lastID: b.lastID} // a new client
+	}
 
-		case c := <-b.closeChan:
-			close(c)
-			delete(b.clients, c)
-			if c == client {
-				return
-			}
+	if lastID > b.lastID {
+		// The client knows events we don't: the server must have restarted.
+		return resume{ok: false, lastID: b.lastID}
+	}
+
+	if lastID < b.trimmedID {
+		return resume{ok: false, lastID: b.lastID}
+	}
+
+	events := []Event{}
+	for _, e := range b.backlog {
+		if e.ID <= lastID {
+			continue
+		}
+		if e, ok := filter.Apply(e); ok {
+			events = append(events, e)
 		}
 	}
+	return resume{missed: events, ok: true, lastID: b.lastID}
+}
+
+// send queues an event for a client. If the client's queue is full, the
+// broker's policy is applied.
+func (b *MemoryBroker) send(client chan Event, e Event) {
+	select {
+	case client <- e:
+		b.count(func(stats *BrokerStats) { stats.Sent++ })
+
+	default:
+		if b.policy == DropEvents {
+			b.count(func(stats *BrokerStats) { stats.Dropped++ })
+		} else {
+			b.remove(client)
+			b.count(func(stats *BrokerStats) { stats.Evicted++ })
+		}
+	}
+}
+
+// remove closes and forgets a client's channel, if it wasn't already.
+func (b *MemoryBroker) remove(client chan Event) {
+	if _, ok := b.clients[client]; !ok {
+		return
+	}
+
+	close(client)
+	delete(b.clients, client)
+	b.count(func(stats *BrokerStats) { stats.Clients-- })
+}
+
+// count updates the broker's counters.
+func (b *MemoryBroker) count(update func(stats *BrokerStats)) {
+	b.statsMu.Lock()
+	defer b.statsMu.Unlock()
+	update(&b.stats)
 }
@@ -0,0 +1,325 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func newTestBroker(policy SlowClientPolicy) *MemoryBroker {
+	return NewMemoryBroker(func() (Event, error) {
+		return NewEvent("", "snapshot"), nil
+	}, nil, policy)
+}
+
+// broadcastN broadcasts n events and waits for them to be processed.
+func broadcastN(b Broker, n int) {
+	c, _ := b.Subscribe(0, Filter{})
+	for i := 0; i < n; i++ {
+		b.Broadcast(NewEvent("test", i))
+		<-c
+	}
+	b.Unsubscribe(c)
+}
+
+func TestBrokerNewClient(t *testing.T) {
+	b := newTestBroker(Disconnect)
+	broadcastN(b, 2)
+
+	c, got := b.Subscribe(0, Filter{})
+	defer b.Unsubscribe(c)
+
+	want := resume{ok: false, lastID: 2}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("b.Subscribe(0) = %v; got %v", want, got)
+	}
+}
+
+func TestBrokerResume(t *testing.T) {
+	b := newTestBroker(Disconnect)
+	broadcastN(b, 5)
+
+	c, got := b.Subscribe(3, Filter{})
+	defer b.Unsubscribe(c)
+
+	want := resume{
+		missed: []Event{{ID: 4, Type: "test", Data: "3"}, {ID: 5, Type: "test", Data: "4"}},
+		ok:     true,
+		lastID: 5,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("b.Subscribe(3) = %v; got %v", want, got)
+	}
+}
+
+func TestBrokerResumeTooLate(t *testing.T) {
+	b := newTestBroker(Disconnect)
+	broadcastN(b, backlogSize+10)
+
+	tests := []uint64{1, 9, backlogSize + 11}
+	for _, lastID := range tests {
+		c, got := b.Subscribe(lastID, Filter{})
+		b.Unsubscribe(c)
+
+		if got.ok || got.lastID != backlogSize+10 {
+			t.Errorf("b.Subscribe(%v) = {ok: false, lastID: %v}; got %v", lastID, backlogSize+10, got)
+		}
+	}
+
+	c, got := b.Subscribe(10, Filter{})
+	defer b.Unsubscribe(c)
+
+	if !got.ok || len(got.missed) != backlogSize || got.missed[0].Data != fmt.Sprint(10) {
+		t.Errorf("b.Subscribe(10) should return the whole backlog; got %v", got)
+	}
+}
+
+// readEvents connects to an SSE route and returns its first n events (or
+// comments), as raw text.
+func readEvents(t *testing.T, url string, header http.Header, n int) []string {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		t.Fatalf("http.NewRequest() failed: %v", err)
+	}
+	for key, values := range header {
+		req.Header[key] = values
+	}
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("http.Get() failed: %v", err)
+	}
+	defer res.Body.Close()
+
+	events := []string{}
+	scanner := bufio.NewScanner(res.Body)
+	var event []string
+	for len(events) < n && scanner.Scan() {
+		if line := scanner.Text(); line != "" {
+			event = append(event, line)
+		} else if len(event) > 0 {
+			events = append(events, strings.Join(event, "\n"))
+			event = nil
+		}
+	}
+
+	return events
+}
+
+func TestBrokerServeHTTP(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	b := newTestBroker(Disconnect)
+	broadcastN(b, 2)
+
+	router := gin.New()
+	router.GET("/events", b.ServeHTTP)
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	got := readEvents(t, server.URL+"/events", nil, 1)
+	want := []string{"id:2\nevent:snapshot\ndata:\"snapshot\""}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("events = %q; got %q", want, got)
+	}
+
+	got = readEvents(t, server.URL+"/events", http.Header{"Last-Event-ID": {"1"}}, 1)
+	want = []string{"id:2\nevent:test\ndata:1"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("events = %q; got %q", want, got)
+	}
+}
+
+// subscribeSlow subscribes n clients that never read their events.
+func subscribeSlow(b Broker, n int) []chan Event {
+	clients := make([]chan Event, n)
+	for i := range clients {
+		clients[i], _ = b.Subscribe(0, Filter{})
+	}
+	return clients
+}
+
+// broadcastWithin broadcasts n events and fails if it takes too long, meaning
+// that Broadcast waited for clients.
+func broadcastWithin(t *testing.T, b Broker, n int, timeout time.Duration) {
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < n; i++ {
+			b.Broadcast(NewEvent("test", i))
+		}
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		t.Fatalf("broadcasting %v events took more than %v", n, timeout)
+	}
+}
+
+func TestBrokerEvictsSlowClients(t *testing.T) {
+	b := newTestBroker(Disconnect)
+	slow := subscribeSlow(b, 300)
+	broadcastWithin(t, b, 1000, 5*time.Second)
+	broadcastN(b, 1) // wait for the broadcasts to be processed
+
+	for i, c := range slow {
+		received := 0
+		for range c {
+			received++
+		}
+		if received != queueSize {
+			t.Errorf("client #%v received %v events; got %v", i, queueSize, received)
+		}
+		b.Unsubscribe(c)
+	}
+
+	stats := b.Stats()
+	if stats.Evicted != 300 || stats.Clients != 0 {
+		t.Errorf("b.Stats() = {Evicted: 300, Clients: 0}; got %+v", stats)
+	}
+}
+
+func TestBrokerDropsEventsOfSlowClients(t *testing.T) {
+	b := newTestBroker(DropEvents)
+	slow := subscribeSlow(b, 300)
+
+	// The fast client reads every event, as long as they are not sent faster
+	// than it can read them.
+	fast, _ := b.Subscribe(0, Filter{})
+	received := make(chan struct{})
+	go func() {
+		for range fast {
+			received <- struct{}{}
+		}
+	}()
+
+	for i := 0; i < 1000; i++ {
+		b.Broadcast(NewEvent("test", i))
+		select {
+		case <-received:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("fast client didn't receive event #%v", i)
+		}
+	}
+
+	stats := b.Stats()
+	if want := uint64(300 * (1000 - queueSize)); stats.Dropped != want || stats.Evicted != 0 || stats.Clients != 301 {
+		t.Errorf("b.Stats() = {Clients: 301, Dropped: %v, Evicted: 0}; got %+v", want, stats)
+	}
+
+	for _, c := range slow {
+		b.Unsubscribe(c)
+	}
+	b.Unsubscribe(fast)
+}
+
+func TestBrokerClose(t *testing.T) {
+	b := newTestBroker(Disconnect)
+	c, _ := b.Subscribe(0, Filter{})
+	defer b.Unsubscribe(c)
+
+	b.Close(5 * time.Second)
+
+	e, ok := <-c
+	if !ok || e.Type != "shutdown" || e.Retry != 5000 || e.Data != `{"retry":5000}` {
+		t.Errorf("first event = shutdown {retry: 5000}; got %v", e)
+	}
+	if _, ok := <-c; ok {
+		t.Error("client should be disconnected")
+	}
+
+	// The broker doesn't block anymore.
+	b.Broadcast(NewEvent("test", 0))
+	c, _ = b.Subscribe(0, Filter{})
+	if _, ok := <-c; ok {
+		t.Error("new clients should be disconnected")
+	}
+	b.Unsubscribe(c)
+}
+
+func TestFilterApply(t *testing.T) {
+	items := []Item{
+		{BeerID: 1, BarID: 1, Data: "1"},
+		{BeerID: 2, BarID: 1, Data: "2"},
+		{BeerID: 3, BarID: 2, Data: "3"},
+	}
+	update := NewItemEvent("update", items)
+	notice := NewEvent("notice", "hello")
+	versioned := update
+	versioned.Versioned = true
+
+	tests := []struct {
+		filter Filter
+		event  Event
+		want   []Item
+		ok     bool
+	}{
+		{Filter{}, update, items, true},
+		{Filter{Bars: map[uint]bool{1: true}}, update, items[:2], true},
+		{Filter{Bars: map[uint]bool{1: true}, Beers: map[uint]bool{3: true}}, update, items, true},
+		{Filter{Beers: map[uint]bool{4: true}}, update, nil, false},
+		{Filter{Types: map[string]bool{"order": true}}, update, nil, false},
+		{Filter{Types: map[string]bool{"update": true}, Beers: map[uint]bool{2: true}}, update, items[1:2], true},
+		{Filter{Bars: map[uint]bool{1: true}}, notice, nil, true},
+		{Filter{Beers: map[uint]bool{4: true}}, versioned, nil, true},
+		{Filter{Types: map[string]bool{"order": true}}, versioned, nil, false},
+		{Filter{Allowed: map[uint]bool{2: true}}, update, items[2:], true},
+		{Filter{Allowed: map[uint]bool{2: true}, Beers: map[uint]bool{1: true, 3: true}}, update, items[2:], true},
+		{Filter{Allowed: map[uint]bool{2: true}, Bars: map[uint]bool{1: true}}, update, nil, false},
+	}
+
+	for i, test := range tests {
+		got, ok := test.filter.Apply(test.event)
+		if ok != test.ok {
+			t.Errorf("#%v: filter.Apply() ok = %v; got %v", i, test.ok, ok)
+		}
+		if ok && len(got.Items) != len(test.want) {
+			t.Errorf("#%v: filter.Apply() items = %v; got %v", i, test.want, got.Items)
+		}
+	}
+}
+
+func TestBrokerServeHTTPWithFilter(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	b := NewMemoryBroker(func() (Event, error) {
+		return NewItemEvent("", []Item{NewItem(1, 1, "a"), NewItem(2, 2, "b")}), nil
+	}, nil, Disconnect)
+	b.Broadcast(NewItemEvent("order", []Item{NewItem(1, 1, "x")}))
+	b.Broadcast(NewItemEvent("update", []Item{NewItem(1, 1, "c"), NewItem(2, 2, "d")}))
+	b.Broadcast(NewItemEvent("order", []Item{NewItem(2, 2, "e")}))
+	b.Broadcast(NewItemEvent("order", []Item{NewItem(1, 1, "f")}))
+	broadcastN(b, 1)
+
+	router := gin.New()
+	router.GET("/events", b.ServeHTTP)
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	got := readEvents(t, server.URL+"/events?bar=2", nil, 1)
+	want := []string{"id:5\nevent:snapshot\ndata:[\"b\"]"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("events = %q; got %q", want, got)
+	}
+
+	got = readEvents(t, server.URL+"/events?bar=2&types=update,order", http.Header{"Last-Event-ID": {"1"}}, 2)
+	want = []string{"id:2\nevent:update\ndata:[\"d\"]", "id:3\nevent:order\ndata:[\"e\"]"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("events = %q; got %q", want, got)
+	}
+
+	res, err := http.Get(server.URL + "/events?bar=two")
+	if err != nil {
+		t.Fatalf("http.Get() failed: %v", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusBadRequest {
+		t.Errorf("status = %v; got %v", http.StatusBadRequest, res.StatusCode)
+	}
+}
@@ -4,14 +4,15 @@ go 1.17
 
 require (
 	github.com/gin-contrib/cors v1.3.1
+	github.com/gin-contrib/sse v0.1.0
 	github.com/gin-gonic/gin v1.7.7
+	github.com/gorilla/websocket v1.5.0
 	github.com/mattn/go-sqlite3 v1.14.10
 	github.com/qustavo/dotsql v1.1.0
 	golang.org/x/crypto v0.0.0-20220126234351-aa10faf2a1f8
 )
 
 require (
-	github.com/gin-contrib/sse v0.1.0 // indirect
 	github.com/go-playground/locales v0.13.0 // indirect
 	github.com/go-playground/universal-translator v0.17.0 // indirect
 	github.com/go-playground/validator/v10 v10.4.1 // indirect
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// backoffPolicy tells how long to wait before the next login attempt after a
+// number of consecutive failures.
+type backoffPolicy struct {
+	free            int           // failures allowed without waiting
+	base            time.Duration // wait after the first failure that isn't free
+	max             time.Duration // maximum wait, before lockout
+	lockoutFailures int           // failures from which attempts are locked out, if any
+	lockout         time.Duration // wait once locked out
+}
+
+// delay returns the time to wait after a number of consecutive failures.
+func (p backoffPolicy) delay(failures int) time.Duration {
+	switch {
+	case p.lockoutFailures > 0 && failures >= p.lockoutFailures:
+		return p.lockout
+	case failures <= p.free:
+		return 0
+	}
+
+	delay := p.base << (failures - p.free - 1)
+	if delay > p.max || delay <= 0 {
+		return p.max
+	}
+	return delay
+}
+
+var (
+	// nameLimits applies to the attempts made on a single username.
+	nameLimits = backoffPolicy{free: 3, base: time.Second, max: time.Minute, lockoutFailures: 10, lockout: 15 * time.Minute}
+
+	// ipLimits applies to the attempts made from a single IP address. It is
+	// more lenient since a whole bar may share an address.
+	ipLimits = backoffPolicy{free: 10, base: time.Second, max: time.Minute, lockoutFailures: 100, lockout: 15 * time.Minute}
+
+	// badgeLimits applies to the badge attempts made on a single terminal.
+	// Badges are hard to guess and misreads happen, so there is no lockout:
+	// it would keep the whole staff from logging in.
+	badgeLimits = backoffPolicy{free: 10, base: time.Second, max: 30 * time.Second}
+)
+
+// LoginLimiter throttles login attempts per username and per IP address. Each
+// failure makes the next attempt wait exponentially longer, up to a lockout.
+// A success resets the username's failures. Those of the IP address are only
+// forgotten with time, so that a valid account doesn't allow to try others.
+//
+// It is kept in memory: every server instance has its own.
+type LoginLimiter struct {
+	clock    Clock
+	mu       sync.Mutex
+	attempts map[string]*loginAttempts
+}
+
+// loginAttempts are the consecutive failures of a username or IP address.
+type loginAttempts struct {
+	failures int
+	last     time.Time
+	next     time.Time // time from which a new attempt is allowed
+	reported bool      // whether Fail reported the lockout
+}
+
+// NewLoginLimiter creates a limiter that doesn't throttle anything yet.
+func NewLoginLimiter(clock Clock) *LoginLimiter {
+	return &LoginLimiter{clock: clock, attempts: map[string]*loginAttempts{}}
+}
+
+// Attempt tells if an attempt to log in as name from ip is allowed now. If it
+// isn't, it also returns the time to wait.
+//
+// Allowed attempts are recorded as failures right away, so that concurrent
+// attempts are throttled too. Succeed undoes it once the attempt succeeds.
+func (l *LoginLimiter) Attempt(ip, name string) (time.Duration, bool) {
+	return l.attempt(ip, "name:"+name, nameLimits)
+}
+
+// AttemptBadge is like Attempt, for a badge scanned on a terminal. Badge
+// attempts are counted per terminal, as they don't give a username, and are
+// never locked out (see SucceedBadge).
+func (l *LoginLimiter) AttemptBadge(ip string, terminalID uint) (time.Duration, bool) {
+	return l.attempt(ip, badgeKey(terminalID), badgeLimits)
+}
+
+// attempt checks and records an attempt from ip on a key throttled by policy.
+func (l *LoginLimiter) attempt(ip, key string, policy backoffPolicy) (time.Duration, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.clock.Now()
+	l.prune(now)
+
+	var wait time.Duration
+	for _, k := range []string{"ip:" + ip, key} {
+		if a, ok := l.attempts[k]; ok && a.next.Sub(now) > wait {
+			wait = a.next.Sub(now)
+		}
+	}
+	if wait > 0 {
+		return wait, false
+	}
+
+	l.record("ip:"+ip, ipLimits, now)
+	l.record(key, policy, now)
+	return 0, true
+}
+
+// Fail tells that an attempt to log in as name failed. It returns true if the
+// username got locked out, only once per lockout.
+func (l *LoginLimiter) Fail(name string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	a, ok := l.attempts["name:"+name]
+	if !ok || a.failures < nameLimits.lockoutFailures || a.reported {
+		return false
+	}
+
+	a.reported = true
+	return true
+}
+
+// Succeed tells that an attempt to log in as name from ip succeeded, which
+// resets the failures of the username and undoes the attempt for the IP
+// address.
+func (l *LoginLimiter) Succeed(ip, name string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.undo("ip:"+ip, ipLimits)
+	delete(l.attempts, "name:"+name)
+}
+
+// SucceedBadge tells that a badge attempt on a terminal succeeded. Unlike
+// Succeed, it only undoes the attempt: failures of other badges are kept, so
+// that a valid badge doesn't help guessing others.
+func (l *LoginLimiter) SucceedBadge(ip string, terminalID uint) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.undo("ip:"+ip, ipLimits)
+	l.undo(badgeKey(terminalID), badgeLimits)
+}
+
+// badgeKey returns the key of the badge attempts made on a terminal.
+func badgeKey(terminalID uint) string {
+	return fmt.Sprintf("badge:%v", terminalID)
+}
+
+// record adds a failure to a key.
+func (l *LoginLimiter) record(key string, policy backoffPolicy, now time.Time) *loginAttempts {
+	a, ok := l.attempts[key]
+	if !ok {
+		a = &loginAttempts{}
+		l.attempts[key] = a
+	}
+
+	a.failures++
+	a.last = now
+	a.next = now.Add(policy.delay(a.failures))
+	return a
+}
+
+// undo removes a failure recorded by Attempt from a key.
+func (l *LoginLimiter) undo(key string, policy backoffPolicy) {
+	a, ok := l.attempts[key]
+	if !ok {
+		return
+	}
+
+	a.failures--
+	if a.failures <= 0 {
+		delete(l.attempts, key)
+		return
+	}
+	a.next = a.last.Add(policy.delay(a.failures))
+}
+
+// prune forgets the failures that are older than a lockout, so that the
+// limiter doesn't grow indefinitely.
+func (l *LoginLimiter) prune(now time.Time) {
+	for key, a := range l.attempts {
+		if now.Sub(a.last) > nameLimits.lockout && now.After(a.next) {
+			delete(l.attempts, key)
+		}
+	}
+}
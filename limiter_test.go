@@ -0,0 +1,164 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestBackoffDelay(t *testing.T) {
+	tests := []struct {
+		failures int
+		want     time.Duration
+	}{
+		{1, 0},
+		{3, 0},
+		{4, time.Second},
+		{6, 4 * time.Second},
+		{9, 32 * time.Second},
+		{10, 15 * time.Minute},
+	}
+
+	for _, test := range tests {
+		if got := nameLimits.delay(test.failures); got != test.want {
+			t.Errorf("nameLimits.delay(%v) = %v; got %v", test.failures, test.want, got)
+		}
+	}
+
+	if got := ipLimits.delay(90); got != time.Minute {
+		t.Errorf("ipLimits.delay(90) = %v; got %v", time.Minute, got)
+	}
+	if got := badgeLimits.delay(1000); got != 30*time.Second {
+		t.Errorf("badgeLimits.delay(1000) = %v; got %v", 30*time.Second, got)
+	}
+}
+
+func TestLoginLimiter(t *testing.T) {
+	clock := newFakeClock(time.Unix(900, 0))
+	limiter := NewLoginLimiter(clock)
+
+	for i := 0; i < 4; i++ {
+		if _, ok := limiter.Attempt("1.2.3.4", "admin"); !ok {
+			t.Fatalf("attempt #%v should be allowed", i+1)
+		}
+	}
+
+	// The username is throttled, whatever the address, but other usernames
+	// aren't.
+	if wait, ok := limiter.Attempt("5.6.7.8", "admin"); ok || wait != time.Second {
+		t.Errorf("limiter.Attempt() = 1s, false; got %v, %v", wait, ok)
+	}
+	if _, ok := limiter.Attempt("1.2.3.4", "bob"); !ok {
+		t.Errorf("limiter.Attempt() = true; got false")
+	}
+
+	// Failures up to the lockout, which is only reported once.
+	for i := 4; i < 10; i++ {
+		clock.Advance(time.Minute)
+		if _, ok := limiter.Attempt("1.2.3.4", "admin"); !ok {
+			t.Fatalf("attempt #%v should be allowed", i+1)
+		}
+	}
+	if !limiter.Fail("admin") {
+		t.Errorf("limiter.Fail() = true; got false")
+	}
+	if limiter.Fail("admin") {
+		t.Errorf("limiter.Fail() = false; got true")
+	}
+
+	clock.Advance(time.Minute)
+	if wait, ok := limiter.Attempt("1.2.3.4", "admin"); ok || wait != 14*time.Minute {
+		t.Errorf("limiter.Attempt() = 14m, false; got %v, %v", wait, ok)
+	}
+
+	limiter.Succeed("1.2.3.4", "admin")
+	if _, ok := limiter.Attempt("1.2.3.4", "admin"); !ok {
+		t.Errorf("limiter.Attempt() = true; got false")
+	}
+}
+
+func TestLoginLimiterKeepsIPFailures(t *testing.T) {
+	clock := newFakeClock(time.Unix(900, 0))
+	limiter := NewLoginLimiter(clock)
+
+	// Logging in to a valid account in between doesn't allow to try other
+	// usernames indefinitely.
+	for i := 0; i < ipLimits.free+1; i++ {
+		if _, ok := limiter.Attempt("1.2.3.4", "bob"); !ok {
+			t.Fatalf("bob's attempt #%v should be allowed", i+1)
+		}
+		limiter.Succeed("1.2.3.4", "bob")
+
+		if _, ok := limiter.Attempt("1.2.3.4", fmt.Sprintf("user%v", i)); !ok {
+			t.Fatalf("attempt #%v should be allowed", i+1)
+		}
+	}
+
+	if wait, ok := limiter.Attempt("1.2.3.4", "eve"); ok || wait != time.Second {
+		t.Errorf("limiter.Attempt() = 1s, false; got %v, %v", wait, ok)
+	}
+}
+
+func TestLoginLimiterConcurrentAttempts(t *testing.T) {
+	limiter := NewLoginLimiter(newFakeClock(time.Unix(900, 0)))
+
+	// Attempts are throttled even if none of them failed yet: only the ones
+	// the policy allows in a row get through.
+	var allowed int32
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, ok := limiter.Attempt("1.2.3.4", "admin"); ok {
+				atomic.AddInt32(&allowed, 1)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if want := int32(nameLimits.free + 1); allowed != want {
+		t.Errorf("allowed attempts = %v; got %v", want, allowed)
+	}
+}
+
+func TestLoginLimiterBadges(t *testing.T) {
+	clock := newFakeClock(time.Unix(900, 0))
+	limiter := NewLoginLimiter(clock)
+
+	// Badges from different addresses, so that only the terminal's counter
+	// matters.
+	for i := 0; i < badgeLimits.free+1; i++ {
+		if _, ok := limiter.AttemptBadge(fmt.Sprintf("10.0.0.%v", i), 1); !ok {
+			t.Fatalf("attempt #%v should be allowed", i+1)
+		}
+	}
+	if wait, ok := limiter.AttemptBadge("10.0.1.1", 1); ok || wait != time.Second {
+		t.Errorf("limiter.AttemptBadge() = 1s, false; got %v, %v", wait, ok)
+	}
+	if _, ok := limiter.AttemptBadge("10.0.1.1", 2); !ok {
+		t.Errorf("limiter.AttemptBadge() on another terminal = true; got false")
+	}
+
+	// A valid badge only undoes its own attempt.
+	clock.Advance(time.Second)
+	if _, ok := limiter.AttemptBadge("10.0.1.1", 1); !ok {
+		t.Fatalf("limiter.AttemptBadge() = true; got false")
+	}
+	limiter.SucceedBadge("10.0.1.1", 1)
+	if wait, ok := limiter.AttemptBadge("10.0.1.2", 1); ok || wait != time.Second {
+		t.Errorf("limiter.AttemptBadge() = 1s, false; got %v, %v", wait, ok)
+	}
+
+	// There is no lockout.
+	for i := 0; i < 100; i++ {
+		clock.Advance(time.Minute)
+		limiter.AttemptBadge(fmt.Sprintf("10.0.2.%v", i), 1)
+	}
+	clock.Advance(time.Second)
+	if wait, ok := limiter.AttemptBadge("10.0.3.1", 1); ok || wait != 29*time.Second {
+		t.Errorf("limiter.AttemptBadge() = 29s, false; got %v, %v", wait, ok)
+	}
+}
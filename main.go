@@ -1,10 +1,21 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
 	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/gin-contrib/cors"
@@ -15,18 +26,63 @@ type (
 	loginReq struct {
 		Name     string `json:"name" binding:"alphanum,min=3,max=256"`
 		Password string `json:"password" binding:"min=3,max=256"`
+		Label    string `json:"label" binding:"max=256"`
 	}
 
 	createUserReq struct {
 		Name     string `json:"name" binding:"alphanum,min=3,max=256"`
 		Password string `json:"password" binding:"min=3,max=256"`
-		Admin    bool   `json:"admin"`
+		Role     Role   `json:"role" binding:"omitempty,oneof=admin treasurer cashier bartender display"`
+		Bars     []uint `json:"bars"`
+		PIN      string `json:"pin" binding:"omitempty,numeric,min=4,max=8"`
+		Badge    string `json:"badge" binding:"omitempty,min=4,max=256"`
 	}
 
+	// updateUserReq only holds the fields to change: others are nil.
 	updateUserReq struct {
-		Name     string `json:"name" binding:"omitempty,alphanum,min=3,max=256"`
-		Password string `json:"password" binding:"omitempty,min=3,max=256"`
-		Admin    bool   `json:"admin"`
+		Name     *string `json:"name" binding:"omitempty,alphanum,min=3,max=256"`
+		Password *string `json:"password" binding:"omitempty,min=3,max=256"`
+		Role     *Role   `json:"role" binding:"omitempty,oneof=admin treasurer cashier bartender display"`
+		Bars     []uint  `json:"bars"`
+		PIN      *string `json:"pin" binding:"omitempty,numeric,min=4,max=8"`
+		Badge    *string `json:"badge" binding:"omitempty,min=4,max=256"`
+	}
+
+	quickLoginReq struct {
+		Name  string `json:"name" binding:"omitempty,alphanum,min=3,max=256"`
+		PIN   string `json:"pin" binding:"omitempty,max=8"`
+		Badge string `json:"badge" binding:"omitempty,max=256"`
+	}
+
+	terminalReq struct {
+		Name string `json:"name" binding:"min=1,max=256"`
+	}
+
+	apiKeyReq struct {
+		Name    string     `json:"name" binding:"min=1,max=256"`
+		Scopes  []Scope    `json:"scopes" binding:"min=1,dive,oneof=read-events order stats"`
+		Bars    []uint     `json:"bars"`
+		Expires *time.Time `json:"expires" binding:"omitempty,gt"`
+	}
+
+	tuneReq struct {
+		Margin     float64 `form:"margin" binding:"min=0"`
+		Volatility float64 `form:"volatility" binding:"min=0"`
+		Periods    int     `form:"periods" binding:"min=0,max=1000"`
+	}
+
+	auditReq struct {
+		Actor  uint      `form:"actor"`
+		Action string    `form:"action"`
+		Target string    `form:"target"`
+		Since  time.Time `form:"since" time_format:"2006-01-02T15:04:05Z07:00"`
+		Until  time.Time `form:"until" time_format:"2006-01-02T15:04:05Z07:00"`
+		Before uint      `form:"before"`
+		Limit  int       `form:"limit" binding:"min=0,max=500"`
+	}
+
+	noticeReq struct {
+		Message string `json:"message" binding:"min=1,max=1024"`
 	}
 
 	orderReq []struct {
@@ -35,7 +91,31 @@ type (
 	}
 )
 
-const period = 15 * time.Minute
+const (
+	period = 15 * time.Minute
+
+	// shutdownRetry is the time after which clients should reconnect when the
+	// server shuts down.
+	shutdownRetry = 5 * time.Second
+
+	// shutdownTimeout is the time requests have to complete when the server
+	// shuts down.
+	shutdownTimeout = 10 * time.Second
+
+	// defaultAdminPassword is the password of the admin created at startup if
+	// there are no users and no password is given.
+	defaultAdminPassword = "boursière"
+
+	// tokenTTL is the time after which access tokens expire.
+	tokenTTL = 30 * 24 * time.Hour
+
+	// terminalTokenTTL is the time after which access tokens given on
+	// terminals expire.
+	terminalTokenTTL = 4 * time.Hour
+
+	// auditPageSize is the default number of audit entries per page.
+	auditPageSize = 50
+)
 
 func main() {
 	dataSourceName := os.Getenv("DATABASE_FILE")
@@ -48,47 +128,90 @@ func main() {
 		panic(err)
 	}
 
-	count, err := db.Users.Count()
+	if len(os.Args) > 1 {
+		command, ok := commands[os.Args[1]]
+		if !ok {
+			fmt.Fprintf(os.Stderr, "unknown command %q\n", os.Args[1])
+			os.Exit(2)
+		}
+
+		if err := command(db, os.Args[2:]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+
+		return
+	}
+
+	if err := bootstrapAdmin(db.Users, os.Getenv("ADMIN_PASSWORD")); err != nil {
+		panic(err)
+	}
+
+	badgeSecret = []byte(os.Getenv("BADGE_SECRET"))
+	if len(badgeSecret) == 0 {
+		log.Print("BADGE_SECRET is not set: badges could be guessed from a copy of the database")
+	}
+
+	catchUp := CatchUp(os.Getenv("CATCH_UP"))
+	switch catchUp {
+	case "":
+		catchUp = CatchUpNone
+	case CatchUpNone, CatchUpOnce, CatchUpAll:
+	default:
+		panic(fmt.Sprintf("invalid CATCH_UP value %q", catchUp))
+	}
+
+	beers, err := db.Beers.All()
 	if err != nil {
 		panic(err)
 	}
 
-	if count == 0 {
-		if _, err := db.Users.Create("admin", "boursière", true); err != nil {
-			panic(err)
-		}
+	// With BROKER=relay, several instances can share the same database: events
+	// are relayed between them and only one of them updates prices.
+	newBroker := MemoryBrokers(Disconnect)
+	var leader func() bool
+	var elector *Elector
+	switch os.Getenv("BROKER") {
+	case "", "memory":
+	case "relay":
+		hostname, _ := os.Hostname()
+		holder := fmt.Sprintf("%v-%v", hostname, os.Getpid())
+		elector = NewElector(db.Events, systemClock{}, "scheduler", holder, leaseTTL)
+		elector.Start()
+
+		newBroker = RelayBrokers(db.Events, Disconnect)
+		leader = elector.Leader
+	default:
+		panic(fmt.Sprintf("invalid BROKER value %q", os.Getenv("BROKER")))
 	}
 
-	broker := NewBroker()
-	go func() {
-		p := period.Milliseconds()
-		n := time.Now().UnixMilli()
-		t := time.UnixMilli((n/p + 1) * p)
-		time.Sleep(time.Until(t))
-
-		tick := time.NewTicker(period)
-		for {
-			err := db.Beers.UpdatePrices()
-			if err != nil {
-				panic(err)
-			}
+	streams, err := NewStreams(beers, newBroker)
+	if err != nil {
+		panic(err)
+	}
 
-			beers, err := db.Beers.All()
-			if err != nil {
-				panic(err)
-			}
+	scheduler := NewScheduler(db.Beers, systemClock{}, period, catchUp, leader, streams.UpdateBeers)
+	go scheduler.Run()
 
-			broker.Broadcast(gin.H{
-				"type": "update",
-				"data": beers,
-			})
+	ticker, err := NewTicker(db.Beers, streams.Public)
+	if err != nil {
+		panic(err)
+	}
 
-			<-tick.C
-		}
-	}()
+	limiter := NewLoginLimiter(systemClock{})
+
+	router := gin.New()
+	router.Use(gin.LoggerWithFormatter(logFormatter), gin.Recovery(), noCache)
 
-	router := gin.Default()
-	router.Use(noCache)
+	// Client IPs, used to throttle logins, are only read from headers set by
+	// trusted reverse proxies.
+	var proxies []string
+	if env := os.Getenv("TRUSTED_PROXIES"); env != "" {
+		proxies = strings.Split(env, ",")
+	}
+	if err := router.SetTrustedProxies(proxies); err != nil {
+		panic(err)
+	}
 	if gin.IsDebugging() {
 		router.Use(debugCORS())
 	}
@@ -106,7 +229,7 @@ func main() {
 	})
 
 	// Delete all existing beers and upload new ones.
-	router.POST("/api/beers", auth(db.Users, true), func(c *gin.Context) {
+	router.POST("/api/beers", auth(db), authorize(PermManageBeers), func(c *gin.Context) {
 		if c.ContentType() != "text/csv" {
 			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "bad_request"})
 			return
@@ -123,46 +246,60 @@ func main() {
 		}
 
 		for i := range beers {
-			if err := db.Beers.Create(&beers[i]); err != nil {
+			if err := db.Beers.Create(&beers[i], scheduler.Current()); err != nil {
 				panic(err)
 			}
 		}
 
-		broker.Broadcast(gin.H{
-			"type": "update",
-			"data": beers,
-		})
+		all, err := db.Beers.All()
+		if err != nil {
+			panic(err)
+		}
+
+		streams.UpdateBeers(all)
+		auditRequest(db.Audit, c, "beers_imported", "", fmt.Sprintf("%v beers", len(beers)))
 
 		c.JSON(http.StatusCreated, beers)
 	})
 
 	// Get real-time updates of beers' status.
-	router.GET("/api/beers/events", broker.ServeHTTP)
+	router.GET("/api/beers/events", streams.Public.ServeHTTP)
+
+	// Get real-time updates of beers' status and order beers over a
+	// WebSocket.
+	router.GET("/api/beers/ws", serveWebSocket(db, streams))
 
 	// Order beers.
-	router.POST("/api/beers/order", auth(db.Users, false), func(c *gin.Context) {
+	router.POST("/api/beers/order", auth(db), authorize(PermOrder), func(c *gin.Context) {
 		var req orderReq
 		if err := c.BindJSON(&req); err != nil {
 			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "bad_request"})
 			return
 		}
 
-		for _, order := range req {
-			if err := db.Beers.MakeOrder(order.ID, order.OrderedQuantity); err != nil {
-				panic(err)
-			}
+		lines := make([]OrderLine, len(req))
+		for i, line := range req {
+			lines[i] = OrderLine(line)
 		}
 
-		broker.Broadcast(gin.H{
-			"type": "order",
-			"data": req,
-		})
+		order, err := placeOrder(db.Beers, streams, c.MustGet("user").(User), lines)
+		if err == errShuttingDown {
+			c.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{"error": "shutting_down"})
+			return
+		} else if err == errWrongBar {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "wrong_bar"})
+			return
+		} else if err != nil {
+			panic(err)
+		}
+
+		auditRequest(db.Audit, c, "order", fmt.Sprintf("order %v", order.ID), orderSummary(lines))
 
 		c.Status(http.StatusNoContent)
 	})
 
 	// Get administration statistics about the event.
-	router.GET("/api/beers/stats", auth(db.Users, true), func(c *gin.Context) {
+	router.GET("/api/beers/stats", auth(db), authorize(PermStats), func(c *gin.Context) {
 		profit, err := db.Beers.EstimatedProfit()
 		if err != nil {
 			panic(err)
@@ -170,11 +307,104 @@ func main() {
 
 		c.JSON(http.StatusOK, gin.H{
 			"estimatedProfit": profit,
+			"scheduler":       scheduler.Status(),
+			"events":          streams.Public.Stats(),
+			"staffEvents":     streams.Staff.Stats(),
 		})
 	})
 
+	// Replay the event's history against another pricing configuration.
+	router.POST("/api/beers/replay", auth(db), authorize(PermStats), func(c *gin.Context) {
+		strategy, ok := strategies[c.DefaultQuery("strategy", "default")]
+		if !ok {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "bad_request"})
+			return
+		}
+
+		beers, err := db.Beers.All()
+		if err != nil {
+			panic(err)
+		}
+
+		if c.ContentType() == "text/csv" {
+			configs, err := LoadBeersFromCSV(c.Request.Body)
+			if err != nil {
+				c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "bad_request"})
+				return
+			}
+
+			ApplyConfig(beers, configs)
+		}
+
+		history, err := db.Beers.History()
+		if err != nil {
+			panic(err)
+		}
+
+		c.JSON(http.StatusOK, ReplayHistory(beers, history, strategy))
+	})
+
+	// Suggest coefficients for a beer catalogue.
+	router.POST("/api/beers/tune", auth(db), authorize(PermStats), func(c *gin.Context) {
+		var req tuneReq
+		if err := c.BindQuery(&req); err != nil || c.ContentType() != "text/csv" || (req.Margin == 0) == (req.Volatility == 0) {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "bad_request"})
+			return
+		}
+
+		data, err := io.ReadAll(c.Request.Body)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "bad_request"})
+			return
+		}
+
+		beers, expected, err := loadTuneCSV(data)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "bad_request"})
+			return
+		}
+
+		if req.Periods == 0 {
+			req.Periods = 24
+		}
+
+		target := TuneTarget{Margin: req.Margin, Volatility: req.Volatility}
+		var buf bytes.Buffer
+		if err := MarshalCSV(&buf, TuneCoefs(beers, expected, req.Periods, target)); err != nil {
+			panic(err)
+		}
+
+		c.Data(http.StatusOK, "text/csv", buf.Bytes())
+	})
+
+	// Get a plain-text ticker of the market.
+	router.GET("/api/ticker", ticker.ServeText)
+
+	// Get the market as compact JSON.
+	router.GET("/api/ticker/json", ticker.ServeJSON)
+
+	// Get an Atom feed of notable price moves.
+	router.GET("/api/ticker/atom", ticker.ServeAtom)
+
+	// Get real-time events reserved to the staff.
+	router.GET("/api/staff/events", auth(db), authorize(PermStaffEvents), streams.Staff.ServeHTTP)
+
+	// Send a notice to the staff.
+	router.POST("/api/staff/notices", auth(db), authorize(PermNotify), func(c *gin.Context) {
+		var req noticeReq
+		if err := c.BindJSON(&req); err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "bad_request"})
+			return
+		}
+
+		streams.Notify(c.MustGet("user").(User), req.Message)
+		auditRequest(db.Audit, c, "notice", "", req.Message)
+
+		c.Status(http.StatusNoContent)
+	})
+
 	// Get the list of all users.
-	router.GET("/api/users", auth(db.Users, true), func(c *gin.Context) {
+	router.GET("/api/users", auth(db), authorize(PermManageUsers), func(c *gin.Context) {
 		users, err := db.Users.All()
 		if err != nil {
 			panic(err)
@@ -184,24 +414,40 @@ func main() {
 	})
 
 	// Create a new user.
-	router.POST("/api/users", auth(db.Users, true), func(c *gin.Context) {
+	router.POST("/api/users", auth(db), authorize(PermManageUsers), func(c *gin.Context) {
 		var req createUserReq
 		if err := c.BindJSON(&req); err != nil {
 			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "bad_request"})
 			return
 		}
 
-		user, err := db.Users.Create(req.Name, req.Password, req.Admin)
-		if err != nil {
+		if req.Role == "" {
+			req.Role = RoleBartender
+		}
+
+		if req.Badge != "" {
+			if _, err := db.Users.ByBadge(req.Badge); err == nil {
+				c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "non_unique_badge"})
+				return
+			}
+		}
+
+		user := User{Name: req.Name, Role: req.Role, Bars: req.Bars}
+		user.SetPassword(req.Password)
+		user.SetPIN(req.PIN)
+		user.SetBadge(req.Badge)
+		if err := db.Users.Create(&user); err != nil {
 			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "non_unique_name"})
 			return
 		}
 
+		auditRequest(db.Audit, c, "user_created", fmt.Sprintf("user %v", user.ID), fmt.Sprintf("%v (%v)", user.Name, user.Role))
+
 		c.JSON(http.StatusCreated, user)
 	})
 
 	// Edit a user.
-	router.PATCH("/api/users/:id", auth(db.Users, false), func(c *gin.Context) {
+	router.PATCH("/api/users/:id", auth(db), authorize(PermAccount), func(c *gin.Context) {
 		id64, err := strconv.ParseUint(c.Param("id"), 10, 0)
 		if err != nil {
 			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "bad_request"})
@@ -216,7 +462,11 @@ func main() {
 
 		id := uint(id64)
 		client := c.MustGet("user").(User)
-		if !client.Admin && (client.ID != id || req.Admin) {
+		if client.MustChangePassword && (client.ID != id || req.Password == nil) {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "password_change_required"})
+			return
+		}
+		if !client.Role.Can(PermManageUsers) && (client.ID != id || req.Role != nil || req.Bars != nil || req.Badge != nil) {
 			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "unauthorized"})
 			return
 		}
@@ -227,24 +477,52 @@ func main() {
 			return
 		}
 
-		user.Admin = req.Admin
-		if req.Name != "" {
-			user.Name = req.Name
+		if req.Role != nil {
+			user.Role = *req.Role
+		}
+		if req.Bars != nil {
+			user.Bars = req.Bars
 		}
-		if req.Password != "" {
-			user.SetPassword(req.Password)
+		if req.Name != nil {
+			user.Name = *req.Name
+		}
+		if req.PIN != nil {
+			user.SetPIN(*req.PIN)
+		}
+		if req.Badge != nil {
+			if other, err := db.Users.ByBadge(*req.Badge); err == nil && other.ID != user.ID {
+				c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "non_unique_badge"})
+				return
+			}
+			user.SetBadge(*req.Badge)
+		}
+		if req.Password != nil {
+			if user.MustChangePassword && user.CheckPassword(*req.Password) {
+				c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "same_password"})
+				return
+			}
+
+			user.SetPassword(*req.Password)
+			if client.ID == id {
+				user.MustChangePassword = false
+			}
 		}
 
-		if err := db.Users.Update(&user); err != nil {
+		if err := db.Users.Update(&user); err == errLastAdmin {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "last_admin"})
+			return
+		} else if err != nil {
 			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "non_unique_name"})
 			return
 		}
 
+		auditRequest(db.Audit, c, "user_updated", fmt.Sprintf("user %v", user.ID), req.changes())
+
 		c.JSON(http.StatusOK, user)
 	})
 
 	// Delete a user.
-	router.DELETE("/api/users/:id", auth(db.Users, true), func(c *gin.Context) {
+	router.DELETE("/api/users/:id", auth(db), authorize(PermManageUsers), func(c *gin.Context) {
 		id64, err := strconv.ParseUint(c.Param("id"), 10, 0)
 		if err != nil {
 			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "bad_request"})
@@ -252,10 +530,78 @@ func main() {
 		}
 
 		id := uint(id64)
-		if err := db.Users.Delete(id); err != nil {
+		found, err := db.Users.Delete(id)
+		if err == errLastAdmin {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "last_admin"})
+			return
+		} else if err != nil {
+			panic(err)
+		}
+		if !found {
+			c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "invalid_id"})
+			return
+		}
+
+		auditRequest(db.Audit, c, "user_deleted", fmt.Sprintf("user %v", id), "")
+
+		c.Status(http.StatusNoContent)
+	})
+
+	// Get a user's access tokens.
+	router.GET("/api/users/:id/tokens", auth(db), authorize(PermAccount), func(c *gin.Context) {
+		id, ok := userParam(c, db.Users)
+		if !ok {
+			return
+		}
+
+		tokens, err := db.Users.Tokens(id)
+		if err != nil {
+			panic(err)
+		}
+
+		c.JSON(http.StatusOK, tokens)
+	})
+
+	// Revoke all of a user's access tokens.
+	router.DELETE("/api/users/:id/tokens", auth(db), authorize(PermAccount), func(c *gin.Context) {
+		id, ok := userParam(c, db.Users)
+		if !ok {
+			return
+		}
+
+		if err := db.Users.DeleteTokens(id); err != nil {
 			panic(err)
 		}
 
+		auditRequest(db.Audit, c, "tokens_revoked", fmt.Sprintf("user %v", id), "")
+
+		c.Status(http.StatusNoContent)
+	})
+
+	// Revoke one of a user's access tokens.
+	router.DELETE("/api/users/:id/tokens/:tokenId", auth(db), authorize(PermAccount), func(c *gin.Context) {
+		id, ok := userParam(c, db.Users)
+		if !ok {
+			return
+		}
+
+		tokenID, err := strconv.ParseUint(c.Param("tokenId"), 10, 0)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "bad_request"})
+			return
+		}
+
+		found, err := db.Users.DeleteTokenByID(id, uint(tokenID))
+		if err != nil {
+			panic(err)
+		}
+		if !found {
+			c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "invalid_id"})
+			return
+		}
+
+		auditRequest(db.Audit, c, "token_revoked", fmt.Sprintf("user %v", id), fmt.Sprintf("token %v", tokenID))
+
 		c.Status(http.StatusNoContent)
 	})
 
@@ -267,36 +613,375 @@ func main() {
 			return
 		}
 
+		ip := c.ClientIP()
+		if wait, ok := limiter.Attempt(ip, req.Name); !ok {
+			c.Header("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{"error": "too_many_attempts"})
+			return
+		}
+
 		user, err := db.Users.ByName(req.Name)
 		if err != nil || !user.CheckPassword(req.Password) {
+			auditRequest(db.Audit, c, "login_failed", req.Name, "")
+			if limiter.Fail(req.Name) {
+				auditRequest(db.Audit, c, "login_locked", req.Name, fmt.Sprintf("locked out for %v", nameLimits.lockout))
+			}
+
 			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "wrong_credentials"})
 			return
 		}
+		limiter.Succeed(ip, req.Name)
+
+		token, err := db.Users.CreateToken(user.ID, 0, req.Label, tokenTTL)
+		if err != nil {
+			panic(err)
+		}
+
+		audit(db.Audit, ip, user.ID, "login", fmt.Sprintf("user %v", user.ID), req.Label)
+
+		c.JSON(http.StatusCreated, loginResponse(user, token))
+	})
+
+	// Get audit entries, most recent first.
+	router.GET("/api/audit", auth(db), authorize(PermAudit), func(c *gin.Context) {
+		var req auditReq
+		if err := c.BindQuery(&req); err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "bad_request"})
+			return
+		}
+
+		q := AuditQuery{
+			ActorID: req.Actor,
+			Target:  req.Target,
+			Since:   req.Since,
+			Until:   req.Until,
+			Before:  req.Before,
+		}
+		if req.Action != "" {
+			q.Actions = strings.Split(req.Action, ",")
+		}
+		limit := req.Limit
+		if limit == 0 {
+			limit = auditPageSize
+		}
+		q.Limit = limit + 1 // to know if there is a next page
+
+		entries, err := db.Audit.Find(q)
+		if err != nil {
+			panic(err)
+		}
+
+		res := gin.H{"entries": entries}
+		if len(entries) > limit {
+			entries = entries[:limit]
+			res["entries"] = entries
+			res["next"] = entries[limit-1].ID
+		}
+		c.JSON(http.StatusOK, res)
+	})
 
-		token, err := db.Users.CreateToken(user.ID)
+	// Get the list of all terminals.
+	router.GET("/api/terminals", auth(db), authorize(PermManageUsers), func(c *gin.Context) {
+		terminals, err := db.Terminals.All()
 		if err != nil {
 			panic(err)
 		}
 
+		c.JSON(http.StatusOK, terminals)
+	})
+
+	// Register a new terminal.
+	router.POST("/api/terminals", auth(db), authorize(PermManageUsers), func(c *gin.Context) {
+		var req terminalReq
+		if err := c.BindJSON(&req); err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "bad_request"})
+			return
+		}
+
+		terminal, secret, err := db.Terminals.Create(req.Name)
+		if err != nil {
+			panic(err)
+		}
+
+		auditRequest(db.Audit, c, "terminal_registered", fmt.Sprintf("terminal %v", terminal.ID), terminal.Name)
+
+		c.JSON(http.StatusCreated, gin.H{
+			"id":      terminal.ID,
+			"name":    terminal.Name,
+			"created": terminal.Created,
+			"secret":  secret,
+		})
+	})
+
+	// Unregister a terminal.
+	router.DELETE("/api/terminals/:id", auth(db), authorize(PermManageUsers), func(c *gin.Context) {
+		id, err := strconv.ParseUint(c.Param("id"), 10, 0)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "bad_request"})
+			return
+		}
+
+		found, err := db.Terminals.Delete(uint(id))
+		if err != nil {
+			panic(err)
+		}
+		if !found {
+			c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "invalid_id"})
+			return
+		}
+
+		auditRequest(db.Audit, c, "terminal_deleted", fmt.Sprintf("terminal %v", id), "")
+
+		c.Status(http.StatusNoContent)
+	})
+
+	// Generate a new access token, bound to a terminal, in exchange for a PIN
+	// or a badge.
+	router.POST("/api/terminals/token", func(c *gin.Context) {
+		terminal, err := db.Terminals.BySecret(requestTerminal(c))
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "unknown_terminal"})
+			return
+		}
+
+		var req quickLoginReq
+		if err := c.BindJSON(&req); err != nil || (req.Badge == "") == (req.PIN == "" || req.Name == "") {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "bad_request"})
+			return
+		}
+
+		ip := c.ClientIP()
+		var wait time.Duration
+		var ok bool
+		if req.Badge != "" {
+			wait, ok = limiter.AttemptBadge(ip, terminal.ID)
+		} else {
+			wait, ok = limiter.Attempt(ip, req.Name)
+		}
+		if !ok {
+			c.Header("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{"error": "too_many_attempts"})
+			return
+		}
+
+		var user User
+		if req.Badge != "" {
+			user, err = db.Users.ByBadge(req.Badge)
+		} else if user, err = db.Users.ByName(req.Name); err == nil && !user.CheckPIN(req.PIN) {
+			err = errors.New("wrong PIN")
+		}
+		if err != nil && req.Badge != "" {
+			auditRequest(db.Audit, c, "quick_login_failed", "badge", terminal.Name)
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "wrong_credentials"})
+			return
+		} else if err != nil {
+			auditRequest(db.Audit, c, "quick_login_failed", req.Name, terminal.Name)
+			if limiter.Fail(req.Name) {
+				auditRequest(db.Audit, c, "login_locked", req.Name, fmt.Sprintf("locked out for %v", nameLimits.lockout))
+			}
+
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "wrong_credentials"})
+			return
+		}
+
+		if req.Badge != "" {
+			limiter.SucceedBadge(ip, terminal.ID)
+		} else {
+			limiter.Succeed(ip, req.Name)
+		}
+
+		token, err := db.Users.CreateToken(user.ID, terminal.ID, terminal.Name, terminalTokenTTL)
+		if err != nil {
+			panic(err)
+		}
+
+		audit(db.Audit, ip, user.ID, "quick_login", fmt.Sprintf("user %v", user.ID), terminal.Name)
+
+		c.JSON(http.StatusCreated, loginResponse(user, token))
+	})
+
+	// Get the list of all API keys.
+	router.GET("/api/keys", auth(db), authorize(PermManageUsers), func(c *gin.Context) {
+		keys, err := db.APIKeys.All()
+		if err != nil {
+			panic(err)
+		}
+
+		c.JSON(http.StatusOK, keys)
+	})
+
+	// Create a new API key.
+	router.POST("/api/keys", auth(db), authorize(PermManageUsers), func(c *gin.Context) {
+		var req apiKeyReq
+		if err := c.BindJSON(&req); err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "bad_request"})
+			return
+		}
+
+		key := APIKey{Name: req.Name, Scopes: req.Scopes, Bars: req.Bars, Expires: req.Expires}
+		value, err := db.APIKeys.Create(&key)
+		if err != nil {
+			panic(err)
+		}
+
+		auditRequest(db.Audit, c, "api_key_created", fmt.Sprintf("API key %v", key.ID), key.Name)
+
 		c.JSON(http.StatusCreated, gin.H{
-			"id":    user.ID,
-			"name":  user.Name,
-			"admin": user.Admin,
-			"token": token,
+			"id":      key.ID,
+			"name":    key.Name,
+			"scopes":  key.Scopes,
+			"bars":    key.Bars,
+			"created": key.Created,
+			"expires": key.Expires,
+			"key":     value,
 		})
 	})
 
+	// Revoke an API key.
+	router.DELETE("/api/keys/:id", auth(db), authorize(PermManageUsers), func(c *gin.Context) {
+		id, err := strconv.ParseUint(c.Param("id"), 10, 0)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "bad_request"})
+			return
+		}
+
+		found, err := db.APIKeys.Delete(uint(id))
+		if err != nil {
+			panic(err)
+		}
+		if !found {
+			c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "invalid_id"})
+			return
+		}
+
+		auditRequest(db.Audit, c, "api_key_revoked", fmt.Sprintf("API key %v", id), "")
+
+		c.Status(http.StatusNoContent)
+	})
+
 	// Delete an access token.
-	router.DELETE("/api/users/token", auth(db.Users, false), func(c *gin.Context) {
+	router.DELETE("/api/users/token", auth(db), authorize(PermAccount), func(c *gin.Context) {
 		token := c.MustGet("token").(string)
 		if err := db.Users.DeleteToken(token); err != nil {
 			panic(err)
 		}
 
+		user := c.MustGet("user").(User)
+		auditRequest(db.Audit, c, "logout", fmt.Sprintf("user %v", user.ID), "")
+
 		c.Status(http.StatusNoContent)
 	})
 
-	router.Run()
+	addr := ":8080"
+	if port := os.Getenv("PORT"); port != "" {
+		addr = ":" + port
+	}
+
+	server := &http.Server{Addr: addr, Handler: router}
+	go func() {
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			panic(err)
+		}
+	}()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	<-ctx.Done()
+
+	// Refuse new orders, let the current price update complete, tell clients
+	// to reconnect (hopefully to a new instance) and wait for the remaining
+	// requests before closing the database.
+	log.Println("shutting down")
+	streams.Drain()
+	scheduler.Stop()
+	if elector != nil {
+		elector.Stop()
+	}
+	streams.Close(shutdownRetry)
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		log.Printf("shutdown: %v", err)
+	}
+
+	if err := db.Close(); err != nil {
+		log.Printf("shutdown: %v", err)
+	}
+}
+
+// bootstrapAdmin creates an admin if there are no users. Its password is the
+// given one or, if empty, the default one, which must be changed. The default
+// admin of existing databases must change its password too, if it didn't
+// already.
+func bootstrapAdmin(users UserManager, password string) error {
+	count, err := users.Count()
+	if err != nil {
+		return err
+	}
+
+	if count == 0 {
+		user := User{Name: "admin", Role: RoleAdmin, MustChangePassword: password == ""}
+		if user.MustChangePassword {
+			password = defaultAdminPassword
+		}
+
+		user.SetPassword(password)
+		return users.Create(&user)
+	}
+
+	user, err := users.ByName("admin")
+	if err == sql.ErrNoRows {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	if !user.MustChangePassword && user.CheckPassword(defaultAdminPassword) {
+		log.Printf("admin still has the default password, it must be changed")
+		user.MustChangePassword = true
+		return users.Update(&user)
+	}
+
+	return nil
+}
+
+// placeOrder records an order made by a user and broadcasts it (see
+// Streams.Ordered). Orders are refused with errShuttingDown while the server
+// is shutting down, and with errWrongBar if they contain beers from bars the
+// user doesn't work at.
+func placeOrder(beers BeerManager, streams *Streams, user User, lines []OrderLine) (Order, error) {
+	order := Order{UserID: user.ID, Timestamp: time.Now(), Lines: lines}
+	if streams.Draining() {
+		return order, errShuttingDown
+	}
+
+	if len(user.Bars) > 0 {
+		all, err := beers.All()
+		if err != nil {
+			return order, err
+		}
+
+		for _, beer := range all {
+			for _, line := range lines {
+				if line.ID == beer.ID && !user.AtBar(beer.BarID) {
+					return order, errWrongBar
+				}
+			}
+		}
+	}
+
+	if err := beers.CreateOrder(&order); err != nil {
+		return order, err
+	}
+
+	all, err := beers.All()
+	if err != nil {
+		return order, err
+	}
+
+	streams.Ordered(order, user, all)
+	return order, nil
 }
 
 // noCache is a middleware that forbids clients to cache any response.
@@ -304,6 +989,53 @@ func noCache(c *gin.Context) {
 	c.Writer.Header().Set("Cache-Control", "no-store")
 }
 
+// logFormatter formats requests' logs like gin's default logger, except that
+// secrets given as query parameters are masked (see maskSecrets).
+func logFormatter(param gin.LogFormatterParams) string {
+	var statusColor, methodColor, resetColor string
+	if param.IsOutputColor() {
+		statusColor = param.StatusCodeColor()
+		methodColor = param.MethodColor()
+		resetColor = param.ResetColor()
+	}
+
+	if param.Latency > time.Minute {
+		param.Latency = param.Latency.Truncate(time.Second)
+	}
+	return fmt.Sprintf("[GIN] %v |%s %3d %s| %13v | %15s |%s %-7s %s %#v\n%s",
+		param.TimeStamp.Format("2006/01/02 - 15:04:05"),
+		statusColor, param.StatusCode, resetColor,
+		param.Latency,
+		param.ClientIP,
+		methodColor, param.Method, resetColor,
+		maskSecrets(param.Path),
+		param.ErrorMessage,
+	)
+}
+
+// secretParams are the query parameters that can hold secrets: access tokens
+// (see requestToken) and terminals' secrets (see requestTerminal).
+var secretParams = map[string]bool{"token": true, "terminal": true}
+
+// maskSecrets replaces the values of secret query parameters in a path, so
+// that it can be logged.
+func maskSecrets(path string) string {
+	i := strings.IndexByte(path, '?')
+	if i < 0 {
+		return path
+	}
+
+	params := strings.Split(path[i+1:], "&")
+	for j, param := range params {
+		key := strings.SplitN(param, "=", 2)[0]
+		if unescaped, err := url.QueryUnescape(key); err == nil && secretParams[unescaped] {
+			params[j] = key + "=xxx"
+		}
+	}
+
+	return path[:i+1] + strings.Join(params, "&")
+}
+
 // debugCORS is a middleware that allows clients to make cross-origin requests
 // with credentials. It should only be used while debugging!
 func debugCORS() gin.HandlerFunc {
@@ -313,34 +1045,50 @@ func debugCORS() gin.HandlerFunc {
 		"http://localhost:5000",
 	}
 	cfg.AllowCredentials = true
-	cfg.AddAllowHeaders("Authorization")
+	cfg.AddAllowHeaders("Authorization", "X-Terminal", "X-API-Key")
 	return cors.New(cfg)
 }
 
-// auth is a middleware that authenticates requests using access tokens.
+// auth is a middleware that authenticates requests using access tokens. They
+// are given by the Authorization header or, for clients that cannot set
+// headers (e.g. EventSource), the "token" query parameter.
 //
-// Unauthenticated requests are denied and, if admin is set to true, regular
-// users are denied too.
+// Unauthenticated requests are denied, as well as requests of users who must
+// change their password, except to do so (see passwordChangeRoutes). If a
+// request is successfully authenticated, the user and its token are stored in
+// the context for later use (see authorize).
 //
-// If a request is successfully authenticated, the user and its token are
-// stored in the context for later use.
-func auth(users UserManager, admin bool) gin.HandlerFunc {
+// Machine clients can authenticate with an API key instead, given by the
+// X-API-Key header. The key is then stored in the context too, along with the
+// user standing for it (see APIKey.User).
+func auth(db Database) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		auth := c.Request.Header.Get("Authorization")
-		token := strings.TrimPrefix(auth, "Bearer ")
-		if auth == token {
+		if value, ok := requestAPIKey(c); ok {
+			key, err := db.APIKeys.ByKey(value)
+			if err != nil {
+				c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "unauthenticated"})
+				return
+			}
+
+			c.Set("user", key.User())
+			c.Set("apiKey", key)
+			return
+		}
+
+		token, ok := requestToken(c)
+		if !ok {
 			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "unauthenticated"})
 			return
 		}
 
-		user, err := users.ByToken(token)
+		user, err := db.Users.ByToken(token, requestTerminal(c))
 		if err != nil {
 			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "unauthenticated"})
 			return
 		}
 
-		if admin && !user.Admin {
-			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "unauthorized"})
+		if user.MustChangePassword && !passwordChangeRoutes[c.Request.Method+" "+c.FullPath()] {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "password_change_required"})
 			return
 		}
 
@@ -348,3 +1096,162 @@ func auth(users UserManager, admin bool) gin.HandlerFunc {
 		c.Set("token", token)
 	}
 }
+
+// passwordChangeRoutes are the routes users who must change their password
+// can use, by method and path.
+var passwordChangeRoutes = map[string]bool{
+	"PATCH /api/users/:id":    true,
+	"DELETE /api/users/token": true,
+}
+
+// authorize is a middleware that denies requests whose user or API key,
+// authenticated by auth, doesn't have a permission.
+func authorize(perm Permission) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		allowed := c.MustGet("user").(User).Role.Can(perm)
+		if key, ok := c.Get("apiKey"); ok {
+			allowed = key.(APIKey).Can(perm)
+		}
+
+		if !allowed {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "unauthorized"})
+		}
+	}
+}
+
+// audit records an action made by an actor (0 if unknown) from an IP address.
+// Errors are logged, as they shouldn't prevent the action.
+func audit(entries AuditManager, ip string, actor uint, action, target, summary string) {
+	e := AuditEntry{
+		Timestamp: time.Now(),
+		ActorID:   actor,
+		Action:    action,
+		Target:    target,
+		Summary:   summary,
+		IP:        ip,
+	}
+	if err := entries.Record(&e); err != nil {
+		log.Printf("audit: cannot record %q: %v", action, err)
+	}
+}
+
+// auditRequest records an action made through a request, by its
+// authenticated user if any.
+func auditRequest(entries AuditManager, c *gin.Context, action, target, summary string) {
+	var actor uint
+	if user, ok := c.Get("user"); ok {
+		actor = user.(User).ID
+	}
+	if key, ok := c.Get("apiKey"); ok {
+		summary = apiKeySummary(key.(APIKey), summary)
+	}
+	audit(entries, c.ClientIP(), actor, action, target, summary)
+}
+
+// apiKeySummary tells in an audit summary that an action was made with an API
+// key, since it has no actor.
+func apiKeySummary(key APIKey, summary string) string {
+	return strings.TrimSpace(fmt.Sprintf("%v (API key %v)", summary, key.ID))
+}
+
+// orderSummary describes the lines of an order for the audit log, e.g.
+// "#1 ×2, #4 ×-1".
+func orderSummary(lines []OrderLine) string {
+	parts := make([]string, len(lines))
+	for i, line := range lines {
+		parts[i] = fmt.Sprintf("#%v ×%v", line.ID, line.OrderedQuantity)
+	}
+	return strings.Join(parts, ", ")
+}
+
+// changes lists the fields a user update changes for the audit log, without
+// their values as some are secret.
+func (r updateUserReq) changes() string {
+	var fields []string
+	if r.Name != nil {
+		fields = append(fields, "name")
+	}
+	if r.Password != nil {
+		fields = append(fields, "password")
+	}
+	if r.Role != nil {
+		fields = append(fields, "role")
+	}
+	if r.Bars != nil {
+		fields = append(fields, "bars")
+	}
+	if r.PIN != nil {
+		fields = append(fields, "pin")
+	}
+	if r.Badge != nil {
+		fields = append(fields, "badge")
+	}
+	return strings.Join(fields, ", ")
+}
+
+// userParam returns the "id" route parameter of an authenticated request. It
+// aborts the request if the ID is invalid, if the client is neither that user
+// nor allowed to manage users, or if there is no such user.
+func userParam(c *gin.Context, users UserManager) (uint, bool) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 0)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "bad_request"})
+		return 0, false
+	}
+
+	client := c.MustGet("user").(User)
+	if !client.Role.Can(PermManageUsers) && client.ID != uint(id) {
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "unauthorized"})
+		return 0, false
+	}
+
+	if _, err := users.ByID(uint(id)); err == sql.ErrNoRows {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "invalid_id"})
+		return 0, false
+	} else if err != nil {
+		panic(err)
+	}
+
+	return uint(id), true
+}
+
+// requestTerminal returns the secret of the terminal a request comes from, if
+// any. It is given by the X-Terminal header or the "terminal" query
+// parameter.
+func requestTerminal(c *gin.Context) string {
+	if secret := c.Request.Header.Get("X-Terminal"); secret != "" {
+		return secret
+	}
+	return c.Query("terminal")
+}
+
+// loginResponse is the response to a successful login.
+func loginResponse(user User, token string) gin.H {
+	return gin.H{
+		"id":                 user.ID,
+		"name":               user.Name,
+		"role":               user.Role,
+		"bars":               user.Bars,
+		"mustChangePassword": user.MustChangePassword,
+		"token":              token,
+	}
+}
+
+// requestToken returns the access token given by a request, if any.
+func requestToken(c *gin.Context) (string, bool) {
+	auth := c.Request.Header.Get("Authorization")
+	if token := strings.TrimPrefix(auth, "Bearer "); token != auth {
+		return token, true
+	}
+
+	token := c.Query("token")
+	return token, token != ""
+}
+
+// requestAPIKey returns the API key given by the X-API-Key header of a
+// request, if any. Unlike tokens, keys are never read from query parameters,
+// which end up in logs.
+func requestAPIKey(c *gin.Context) (string, bool) {
+	key := c.GetHeader("X-API-Key")
+	return key, key != ""
+}
@@ -0,0 +1,61 @@
+package main
+
+import "testing"
+
+func TestBootstrapAdmin(t *testing.T) {
+	tests := []struct {
+		existing string // password of an existing admin, if any
+		password string
+		want     bool
+	}{
+		{"", "", true},
+		{"", "secret", false},
+		{defaultAdminPassword, "", true},
+		{"changed", "", false},
+	}
+
+	for _, test := range tests {
+		users := newSqliteUserManager()
+		if test.existing != "" {
+			admin := User{Name: "admin", Role: RoleAdmin}
+			admin.SetPassword(test.existing)
+			if err := users.Create(&admin); err != nil {
+				t.Fatalf("users.Create() failed: %v", err)
+			}
+		}
+
+		if err := bootstrapAdmin(users, test.password); err != nil {
+			t.Errorf("bootstrapAdmin() failed: %v", err)
+		}
+
+		user, err := users.ByName("admin")
+		if err != nil {
+			t.Fatalf("users.ByName() failed: %v", err)
+		}
+		if user.MustChangePassword != test.want {
+			t.Errorf("bootstrapAdmin(%q) with %q: user.MustChangePassword = %v; got %v", test.password, test.existing, test.want, user.MustChangePassword)
+		}
+		if test.password != "" && !user.CheckPassword(test.password) {
+			t.Errorf("user.CheckPassword(%q) failed but shouldn't", test.password)
+		}
+	}
+}
+
+func TestMaskSecrets(t *testing.T) {
+	tests := []struct {
+		path string
+		want string
+	}{
+		{"/api/beers", "/api/beers"},
+		{"/api/staff/events?token=abc", "/api/staff/events?token=xxx"},
+		{"/api/beers/ws?bar=1&token=abc&terminal=def&lastEventId=2", "/api/beers/ws?bar=1&token=xxx&terminal=xxx&lastEventId=2"},
+		{"/api/staff/events?tok%65n=abc&tokens=1", "/api/staff/events?tok%65n=xxx&tokens=1"},
+		{"/api/staff/events?token", "/api/staff/events?token=xxx"},
+	}
+
+	for _, test := range tests {
+		if got := maskSecrets(test.path); got != test.want {
+			t.Errorf("maskSecrets(%q) = %q; got %q", test.path, test.want, got)
+		}
+	}
+}
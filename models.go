@@ -1,46 +1,103 @@
 package main
 
 import (
-	"encoding/csv"
-	"fmt"
+	"errors"
 	"io"
 	"math"
-	"reflect"
-	"strconv"
-	"strings"
+	"time"
 
 	"golang.org/x/crypto/bcrypt"
 )
 
 // Database gives access to all models that can be stored.
 type Database struct {
-	Beers BeerManager
-	Users UserManager
+	Beers     BeerManager
+	Users     UserManager
+	Events    EventManager
+	Audit     AuditManager
+	Terminals TerminalManager
+	APIKeys   APIKeyManager
+	close     func() error
+}
+
+// Close closes the underlying database, if any.
+func (d Database) Close() error {
+	if d.close == nil {
+		return nil
+	}
+	return d.close()
 }
 
 // BeerManager includes all possible operations on the Beer model.
 type BeerManager interface {
 	All() ([]Beer, error)
-	Create(b *Beer) error
+	Create(b *Beer, p Period) error
 	DeleteAll() error
 	EstimatedProfit() (float64, error)
+	History() ([]Record, error)
+	LastUpdate() (time.Time, error)
 	MakeOrder(id uint, amount int) error
-	UpdatePrice(id uint, price float64) error
-	UpdatePrices() error
+	CreateOrder(o *Order) error
+	UpdatePrice(id uint, price float64, p Period) error
+	UpdatePrices(p Period) error
 }
 
-// UserManager includes all possible operations on the User model.
+// errLastAdmin is returned by UserManager when an update or a deletion would
+// leave no admin.
+var errLastAdmin = errors.New("last admin")
+
+// UserManager includes all possible operations on the User model. Once there
+// is an admin, Update and Delete refuse to remove the last one.
 type UserManager interface {
 	All() ([]User, error)
 	Count() (uint, error)
 	ByID(id uint) (User, error)
 	ByName(name string) (User, error)
-	ByToken(token string) (User, error)
-	Create(name, password string, admin bool) (User, error)
+	ByToken(token, terminal string) (User, error)
+	ByBadge(badge string) (User, error)
+	Create(u *User) error
 	Update(u *User) error
-	Delete(id uint) error
-	CreateToken(userID uint) (string, error)
+	Delete(id uint) (bool, error)
+	Tokens(userID uint) ([]Token, error)
+	CreateToken(userID, terminalID uint, label string, ttl time.Duration) (string, error)
 	DeleteToken(token string) error
+	DeleteTokenByID(userID, tokenID uint) (bool, error)
+	DeleteTokens(userID uint) error
+}
+
+// EventManager relays events between the server instances sharing a
+// database, and lets them elect one of them to run the scheduler.
+//
+// Published events are numbered in order, across all channels.
+type EventManager interface {
+	Publish(channel string, e Event) error
+	Since(channel string, lastID uint64) ([]Event, error)
+	LastID() (uint64, error)
+	AcquireLease(name, holder string, now time.Time, ttl time.Duration) (bool, error)
+	ReleaseLease(name, holder string) error
+}
+
+// TerminalManager includes all possible operations on the Terminal model.
+type TerminalManager interface {
+	All() ([]Terminal, error)
+	BySecret(secret string) (Terminal, error)
+	Create(name string) (Terminal, string, error)
+	Delete(id uint) (bool, error)
+}
+
+// APIKeyManager includes all possible operations on the APIKey model.
+type APIKeyManager interface {
+	All() ([]APIKey, error)
+	ByKey(key string) (APIKey, error)
+	Create(k *APIKey) (string, error)
+	Delete(id uint) (bool, error)
+}
+
+// AuditManager keeps track of sensitive actions. Entries are never updated
+// nor deleted.
+type AuditManager interface {
+	Record(e *AuditEntry) error
+	Find(q AuditQuery) ([]AuditEntry, error)
 }
 
 // Beer represents a type of beer from the database.
@@ -61,102 +118,36 @@ type Beer struct {
 	DecrCoef             float64 `json:"-" csv:"decrCoef"`
 	MinCoef              float64 `json:"-" csv:"minCoef"`
 	MaxCoef              float64 `json:"-" csv:"maxCoef"`
+	MaxIncrease          float64 `json:"-" csv:"maxIncrease"`
+	MaxDecrease          float64 `json:"-" csv:"maxDecrease"`
+	MaxIncreaseRate      float64 `json:"-" csv:"maxIncreaseRate"`
+	MaxDecreaseRate      float64 `json:"-" csv:"maxDecreaseRate"`
+	MaxRises             int     `json:"-" csv:"maxRises"`
+	ConsecutiveRises     int     `json:"-" csv:"-"`
 }
 
-var (
-	beerType   = reflect.TypeOf(Beer{})
-	beerFields = map[string]reflect.StructField{}
-)
+// Period identifies a pricing period along with the time at which its prices
+// were set. Periods are numbered from the Unix epoch (see Scheduler).
+type Period struct {
+	Number    int64
+	Timestamp time.Time
+}
 
-func init() {
-	for i := 0; i < beerType.NumField(); i++ {
-		field := beerType.Field(i)
-		title := field.Tag.Get("csv")
-		if title == "-" {
-			continue
-		}
-		if title == "" {
-			title = field.Name
-		}
-		beerFields[title] = field
-	}
+// Record represents a beer's sales and price during one period, as stored in
+// the history.
+type Record struct {
+	BeerID       uint    `json:"beerId"`
+	Period       int64   `json:"period"`
+	SoldQuantity int     `json:"soldQuantity"`
+	SellingPrice float64 `json:"sellingPrice"`
 }
 
-// LoadBeersFromCSV parses CSV data and generates beers. It mimics Unmarshal
-// from the standard library.
-//
-// The first row is interpreted as column names and takes the `csv` struct tag
-// into account. Missing columns are ignored and `csv:"-"` tags are omitted.
-//
-// For columns of type float64, "," are replaced with "." to handle French
-// decimal commas. Furthermore, trailling spaces (" ") and euro symbols ("€")
-// are removed.
+// LoadBeersFromCSV parses CSV data and generates beers. See UnmarshalCSV for
+// details about the expected format.
 func LoadBeersFromCSV(source io.Reader) ([]Beer, error) {
-	r := csv.NewReader(source)
-	titles, err := r.Read()
-	if err != nil {
-		return nil, err
-	}
-
-	records, err := r.ReadAll()
-	if err != nil {
-		return nil, err
-	}
-
-	mapping := map[string]int{}
-	for i, title := range titles {
-		if _, ok := beerFields[title]; ok {
-			mapping[title] = i
-		}
-	}
-
 	beers := []Beer{}
-	for _, record := range records {
-		beer := reflect.New(beerType)
-		ptr := reflect.Indirect(beer)
-
-		for title, field := range beerFields {
-			i, ok := mapping[title]
-			if !ok {
-				continue
-			}
-
-			s := record[i]
-			f := ptr.Field(field.Index[0])
-
-			switch field.Type.Kind() {
-			case reflect.Int:
-				v, err := strconv.ParseInt(s, 10, 0)
-				if err != nil {
-					return nil, err
-				}
-				f.SetInt(v)
-
-			case reflect.Uint:
-				v, err := strconv.ParseUint(s, 10, 0)
-				if err != nil {
-					return nil, err
-				}
-				f.SetUint(v)
-
-			case reflect.Float64:
-				s = strings.TrimRight(s, " €")
-				s = strings.ReplaceAll(s, ",", ".")
-				v, err := strconv.ParseFloat(s, 64)
-				if err != nil {
-					return nil, err
-				}
-				f.SetFloat(v)
-
-			case reflect.String:
-				f.SetString(s)
-
-			default:
-				panic(fmt.Sprintf("unmanaged type %v for field %v", field.Type, field.Name))
-			}
-		}
-
-		beers = append(beers, *beer.Interface().(*Beer))
+	if err := UnmarshalCSV(source, &beers); err != nil {
+		return nil, err
 	}
 
 	return beers, nil
@@ -164,6 +155,11 @@ func LoadBeersFromCSV(source io.Reader) ([]Beer, error) {
 
 // NewPrice computes and returns the beer's new price based on its current
 // quantity, price and sold quantity of the last period.
+//
+// Guardrails are applied when set (i.e. non-zero): the price cannot move by
+// more than MaxIncrease/MaxDecrease (absolute) nor MaxIncreaseRate/
+// MaxDecreaseRate (relative to the current price) in one period, and it stops
+// increasing after MaxRises consecutive rises.
 func (b *Beer) NewPrice() float64 {
 	price := b.SellingPrice
 	delta := float64(b.SoldQuantity - b.PreviousSoldQuantity)
@@ -173,11 +169,74 @@ func (b *Beer) NewPrice() float64 {
 		price += b.DecrCoef * delta
 	}
 
+	if b.MaxRises > 0 && b.ConsecutiveRises >= b.MaxRises {
+		price = math.Min(price, b.SellingPrice)
+	}
+	if b.MaxIncrease > 0 {
+		price = math.Min(price, b.SellingPrice+b.MaxIncrease)
+	}
+	if b.MaxIncreaseRate > 0 {
+		price = math.Min(price, b.SellingPrice*(1+b.MaxIncreaseRate))
+	}
+	if b.MaxDecrease > 0 {
+		price = math.Max(price, b.SellingPrice-b.MaxDecrease)
+	}
+	if b.MaxDecreaseRate > 0 {
+		price = math.Max(price, b.SellingPrice*(1-b.MaxDecreaseRate))
+	}
+
 	minPrice := b.MinCoef * b.PurchasePrice
 	maxPrice := b.MaxCoef * b.PurchasePrice
 	return math.Min(math.Max(minPrice, price), maxPrice)
 }
 
+// lowStockRatio is the part of its stock below which a beer is running out.
+const lowStockRatio = 0.1
+
+// Remaining returns the quantity of a beer that is still in stock.
+func (b *Beer) Remaining() int {
+	return b.StockQuantity - b.TotalSoldQuantity
+}
+
+// LowStock tells if a beer would be running out with the given remaining
+// quantity.
+func (b *Beer) LowStock(remaining int) bool {
+	return float64(remaining) <= float64(b.StockQuantity)*lowStockRatio
+}
+
+// ConsecutiveRises counts, for each beer, how many times in a row its price
+// rose up to its most recent period. Records must be sorted by period, as
+// returned by BeerManager.History.
+func ConsecutiveRises(history []Record) map[uint]int {
+	rises := map[uint]int{}
+	previous := map[uint]float64{}
+	for _, r := range history {
+		if p, ok := previous[r.BeerID]; ok && r.SellingPrice > p {
+			rises[r.BeerID]++
+		} else {
+			rises[r.BeerID] = 0
+		}
+		previous[r.BeerID] = r.SellingPrice
+	}
+
+	return rises
+}
+
+// Order represents an order made by a user. Its lines add (or remove, if
+// negative) amounts to beers' sold quantities.
+type Order struct {
+	ID        uint        `json:"id"`
+	UserID    uint        `json:"userId"`
+	Timestamp time.Time   `json:"timestamp"`
+	Lines     []OrderLine `json:"lines"`
+}
+
+// OrderLine is the part of an order about a single beer.
+type OrderLine struct {
+	ID              uint `json:"id"`
+	OrderedQuantity int  `json:"orderedQuantity"`
+}
+
 // User represents a user from the database.
 //
 // Its Password is actually a hash and should not be accessed directly but
@@ -186,7 +245,67 @@ type User struct {
 	ID       uint   `json:"id"`
 	Name     string `json:"name"`
 	Password []byte `json:"-"`
-	Admin    bool   `json:"admin"`
+	Role     Role   `json:"role"`
+	Bars     []uint `json:"bars"`
+	PIN      []byte `json:"-"`
+	Badge    string `json:"-"` // HMAC-SHA256 (see hashBadge)
+
+	// MustChangePassword is set for users who can't do anything but change
+	// their password, e.g. the default admin.
+	MustChangePassword bool `json:"mustChangePassword"`
+}
+
+// Token describes an access token, without its value.
+type Token struct {
+	ID       uint      `json:"id"`
+	UserID   uint      `json:"userId"`
+	Label    string    `json:"label"`
+	Created  time.Time `json:"created"`
+	LastUsed time.Time `json:"lastUsed"`
+	Expires  time.Time `json:"expires"`
+
+	// TerminalID is the terminal the token can only be used on, if any.
+	TerminalID uint `json:"terminalId,omitempty"`
+}
+
+// Terminal is a shared device, such as a till, on which users can log in
+// quickly (see User.SetPIN).
+type Terminal struct {
+	ID      uint      `json:"id"`
+	Name    string    `json:"name"`
+	Created time.Time `json:"created"`
+}
+
+// APIKey lets a machine client, such as a display or a bot, use the routes its
+// scopes allow without a user account.
+type APIKey struct {
+	ID      uint       `json:"id"`
+	Name    string     `json:"name"`
+	Scopes  []Scope    `json:"scopes"`
+	Bars    []uint     `json:"bars"`
+	Created time.Time  `json:"created"`
+	Expires *time.Time `json:"expires"` // nil if the key never expires
+}
+
+// User returns the user that stands for an API key in orders and events. It
+// has no ID nor role, and works at the key's bars.
+func (k APIKey) User() User {
+	return User{Name: k.Name, Bars: k.Bars}
+}
+
+// AtBar tells if a user works at a bar. Users who aren't assigned to any bar
+// work at all of them.
+func (u User) AtBar(barID uint) bool {
+	if len(u.Bars) == 0 {
+		return true
+	}
+
+	for _, bar := range u.Bars {
+		if bar == barID {
+			return true
+		}
+	}
+	return false
 }
 
 // SetPassword hashes, salts and updates a password.
@@ -207,3 +326,58 @@ func (u *User) CheckPassword(password string) bool {
 	err := bcrypt.CompareHashAndPassword(u.Password, []byte(password))
 	return err == nil
 }
+
+// SetPIN hashes, salts and updates a PIN, which lets a user log in on
+// terminals. An empty PIN removes it.
+func (u *User) SetPIN(pin string) {
+	u.PIN = nil
+	if pin == "" {
+		return
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(pin), bcrypt.DefaultCost)
+	if err != nil {
+		panic(err) // see SetPassword
+	}
+
+	u.PIN = hash
+}
+
+// CheckPIN tests a given PIN against the stored hash. It fails if the user
+// has no PIN.
+func (u *User) CheckPIN(pin string) bool {
+	err := bcrypt.CompareHashAndPassword(u.PIN, []byte(pin))
+	return len(u.PIN) > 0 && err == nil
+}
+
+// SetBadge updates the code of a user's badge, which lets them log in on
+// terminals. An empty code removes it.
+func (u *User) SetBadge(code string) {
+	u.Badge = ""
+	if code != "" {
+		u.Badge = hashBadge(code)
+	}
+}
+
+// AuditEntry tells that an actor, if known, did an action on a target.
+type AuditEntry struct {
+	ID        uint      `json:"id"`
+	Timestamp time.Time `json:"timestamp"`
+	ActorID   uint      `json:"actorId,omitempty"`
+	ActorName string    `json:"actorName,omitempty"` // only set by Find
+	Action    string    `json:"action"`
+	Target    string    `json:"target"`
+	Summary   string    `json:"summary"`
+	IP        string    `json:"ip"`
+}
+
+// AuditQuery filters audit entries. Zero values match any entry.
+type AuditQuery struct {
+	ActorID uint
+	Actions []string
+	Target  string
+	Since   time.Time
+	Until   time.Time
+	Before  uint // only entries with a lower ID, for pagination
+	Limit   int
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"bytes"
 	"reflect"
 	"strings"
 	"testing"
@@ -58,6 +59,29 @@ func TestLoadBeersFromCSV(t *testing.T) {
 	}
 }
 
+func TestMarshalCSV(t *testing.T) {
+	beers := []Beer{
+		{ID: 4, BarID: 1, Name: "ho, ho", StockQuantity: 24, PurchasePrice: 1.25, IncrCoef: 0.02},
+		{ID: 5, BarID: 2, Name: "TK", StockQuantity: 48, PurchasePrice: 2, MaxCoef: 1.5},
+	}
+
+	var buf bytes.Buffer
+	if err := MarshalCSV(&buf, beers); err != nil {
+		t.Errorf("MarshalCSV() failed: %v", err)
+	}
+
+	got, err := LoadBeersFromCSV(&buf)
+	if err != nil {
+		t.Errorf("LoadBeersFromCSV() failed: %v", err)
+	}
+
+	beers[0].ID = 0 // IDs are not part of the CSV
+	beers[1].ID = 0
+	if !reflect.DeepEqual(got, beers) {
+		t.Errorf("LoadBeersFromCSV(MarshalCSV()) = %v; got %v", beers, got)
+	}
+}
+
 func TestNewPrice(t *testing.T) {
 	tests := []struct {
 		beer Beer
@@ -123,6 +147,75 @@ func TestNewPrice(t *testing.T) {
 			},
 			want: 1.1, // 27 sold units more but MaxCoef of 1.1
 		},
+		{
+			beer: Beer{
+				SoldQuantity:         20,
+				PreviousSoldQuantity: 10,
+				SellingPrice:         1,
+				PurchasePrice:        1,
+				IncrCoef:             0.05,
+				MinCoef:              0.5,
+				MaxCoef:              2,
+				MaxIncrease:          0.2,
+			},
+			want: 1.2, // 10 sold units more but MaxIncrease of 0.2
+		},
+		{
+			beer: Beer{
+				SoldQuantity:         20,
+				PreviousSoldQuantity: 10,
+				SellingPrice:         1,
+				PurchasePrice:        1,
+				IncrCoef:             0.05,
+				MinCoef:              0.5,
+				MaxCoef:              2,
+				MaxIncrease:          0.2,
+				MaxIncreaseRate:      0.1,
+			},
+			want: 1.1, // 10 sold units more but MaxIncreaseRate of 10%
+		},
+		{
+			beer: Beer{
+				SoldQuantity:         0,
+				PreviousSoldQuantity: 10,
+				SellingPrice:         1,
+				PurchasePrice:        1,
+				DecrCoef:             0.05,
+				MinCoef:              0.5,
+				MaxCoef:              2,
+				MaxDecrease:          0.3,
+				MaxDecreaseRate:      0.4,
+			},
+			want: 0.7, // 10 sold units less but MaxDecrease of 0.3
+		},
+		{
+			beer: Beer{
+				SoldQuantity:         20,
+				PreviousSoldQuantity: 10,
+				SellingPrice:         1.5,
+				PurchasePrice:        1,
+				IncrCoef:             0.05,
+				MinCoef:              0.5,
+				MaxCoef:              2,
+				MaxRises:             3,
+				ConsecutiveRises:     3,
+			},
+			want: 1.5, // 10 sold units more but already 3 consecutive rises
+		},
+		{
+			beer: Beer{
+				SoldQuantity:         0,
+				PreviousSoldQuantity: 10,
+				SellingPrice:         1.5,
+				PurchasePrice:        1,
+				DecrCoef:             0.05,
+				MinCoef:              0.5,
+				MaxCoef:              2,
+				MaxRises:             3,
+				ConsecutiveRises:     3,
+			},
+			want: 1, // 10 sold units less, MaxRises doesn't prevent decreases
+		},
 	}
 
 	for _, test := range tests {
@@ -134,6 +227,25 @@ func TestNewPrice(t *testing.T) {
 	}
 }
 
+func TestConsecutiveRises(t *testing.T) {
+	history := []Record{
+		{BeerID: 1, SellingPrice: 1},
+		{BeerID: 1, SellingPrice: 1.2},
+		{BeerID: 1, SellingPrice: 1.3},
+		{BeerID: 1, SellingPrice: 1.4},
+		{BeerID: 2, SellingPrice: 1},
+		{BeerID: 2, SellingPrice: 1.2},
+		{BeerID: 2, SellingPrice: 1.2},
+		{BeerID: 3, SellingPrice: 1},
+	}
+
+	got := ConsecutiveRises(history)
+	want := map[uint]int{1: 3, 2: 0, 3: 0}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ConsecutiveRises() = %v; got %v", want, got)
+	}
+}
+
 func TestPassword(t *testing.T) {
 	var user User
 	user.SetPassword("helloworld")
@@ -145,3 +257,42 @@ func TestPassword(t *testing.T) {
 		t.Error("user.CheckPassword() succeeded but shouldn't")
 	}
 }
+
+func TestPIN(t *testing.T) {
+	var user User
+	if user.CheckPIN("") {
+		t.Error("user.CheckPIN() succeeded but shouldn't")
+	}
+
+	user.SetPIN("1234")
+	if !user.CheckPIN("1234") {
+		t.Error("user.CheckPIN() failed but shouldn't")
+	}
+	if user.CheckPIN("4321") {
+		t.Error("user.CheckPIN() succeeded but shouldn't")
+	}
+
+	user.SetPIN("")
+	if user.CheckPIN("") {
+		t.Error("user.CheckPIN() succeeded but shouldn't")
+	}
+}
+
+func TestUserAtBar(t *testing.T) {
+	tests := []struct {
+		bars  []uint
+		barID uint
+		want  bool
+	}{
+		{nil, 2, true},
+		{[]uint{1, 3}, 1, true},
+		{[]uint{1, 3}, 2, false},
+	}
+
+	for _, test := range tests {
+		user := User{Bars: test.bars}
+		if got := user.AtBar(test.barID); got != test.want {
+			t.Errorf("User{Bars: %v}.AtBar(%v) = %v; got %v", test.bars, test.barID, test.want, got)
+		}
+	}
+}
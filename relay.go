@@ -0,0 +1,203 @@
+package main
+
+import (
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// relayPollPeriod is the time between two checks for relayed events.
+	relayPollPeriod = 250 * time.Millisecond
+
+	// leaseTTL is the time after which a leader that stopped renewing its
+	// lease is replaced.
+	leaseTTL = 30 * time.Second
+)
+
+// RelayBroker is a Broker whose events reach the clients of every server
+// instance sharing the same database.
+//
+// Broadcasted events are published in the database, which numbers them. Every
+// instance, including the one that published them, polls the database and
+// sends them to its own clients through a MemoryBroker. Hence, event IDs are
+// the same across instances and clients can reconnect to any of them. Clients
+// resuming from an event published before the instance started receive a
+// snapshot, as the instance doesn't know what they missed.
+//
+// Transformations, however, depend on each instance's state (see BeerDeltas).
+type RelayBroker struct {
+	*MemoryBroker
+	events  EventManager
+	channel string
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+// RelayBrokers returns a BrokerFunc that creates relayed brokers.
+func RelayBrokers(events EventManager, policy SlowClientPolicy) BrokerFunc {
+	return func(channel string, snapshot func() (Event, error), transform func(e Event) (Event, bool)) (Broker, error) {
+		b, err := NewRelayBroker(events, channel, snapshot, transform, policy)
+		if err != nil {
+			return nil, err
+		}
+		return b, nil
+	}
+}
+
+// NewRelayBroker creates a ready-to-use broker relaying its events through a
+// channel of the database. Only events published from now on are relayed. See
+// NewMemoryBroker for the other parameters.
+func NewRelayBroker(events EventManager, channel string, snapshot func() (Event, error), transform func(e Event) (Event, bool), policy SlowClientPolicy) (*RelayBroker, error) {
+	lastID, err := events.LastID()
+	if err != nil {
+		return nil, err
+	}
+
+	b := &RelayBroker{
+		MemoryBroker: newMemoryBroker(lastID, snapshot, transform, policy),
+		events:       events,
+		channel:      channel,
+		stop:         make(chan struct{}),
+		done:         make(chan struct{}),
+	}
+
+	go b.poll(lastID)
+	return b, nil
+}
+
+// Broadcast publishes an event so that it's sent to the clients of every
+// instance. Errors are logged, as events are not critical. Events broadcasted
+// after Close are dropped.
+func (b *RelayBroker) Broadcast(e Event) {
+	select {
+	case <-b.stop:
+		return
+	default:
+	}
+
+	if err := b.events.Publish(b.channel, e); err != nil {
+		log.Printf("relay: cannot publish %q event: %v", e.Type, err)
+	}
+}
+
+// Close stops relaying events and closes the underlying MemoryBroker.
+func (b *RelayBroker) Close(retry time.Duration) {
+	close(b.stop)
+	<-b.done
+	b.MemoryBroker.Close(retry)
+}
+
+// poll sends the events published after lastID to local clients, until the
+// broker is closed.
+func (b *RelayBroker) poll(lastID uint64) {
+	defer close(b.done)
+
+	ticker := time.NewTicker(relayPollPeriod)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			events, err := b.events.Since(b.channel, lastID)
+			if err != nil {
+				log.Printf("relay: cannot receive events: %v", err)
+				continue
+			}
+
+			for _, e := range events {
+				b.MemoryBroker.Broadcast(e)
+				lastID = e.ID
+			}
+		case <-b.stop:
+			return
+		}
+	}
+}
+
+// Elector elects, among the server instances sharing the same database, the
+// one that runs the scheduler. The leader holds a lease that it renews
+// periodically. If it stops doing so, another instance takes over once the
+// lease expires.
+type Elector struct {
+	events EventManager
+	clock  Clock
+	name   string
+	holder string
+	ttl    time.Duration
+	leader int32
+	stop   chan struct{}
+	done   chan struct{}
+}
+
+// NewElector creates an elector for the given lease. The holder identifies
+// the current instance and must be unique.
+func NewElector(events EventManager, clock Clock, name, holder string, ttl time.Duration) *Elector {
+	return &Elector{
+		events: events,
+		clock:  clock,
+		name:   name,
+		holder: holder,
+		ttl:    ttl,
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+}
+
+// Start tries to acquire the lease and then, in a new goroutine, tries to
+// acquire or renew it three times per TTL, until Stop is called.
+func (e *Elector) Start() {
+	e.elect()
+	go e.run()
+}
+
+// run renews the lease periodically.
+func (e *Elector) run() {
+	defer close(e.done)
+
+	for {
+		select {
+		case <-e.clock.After(e.ttl / 3):
+			e.elect()
+		case <-e.stop:
+			return
+		}
+	}
+}
+
+// Leader tells if the current instance holds the lease.
+func (e *Elector) Leader() bool {
+	return atomic.LoadInt32(&e.leader) == 1
+}
+
+// Stop stops a running elector and releases its lease, if held, so that
+// another instance can take over right away.
+func (e *Elector) Stop() {
+	close(e.stop)
+	<-e.done
+
+	if e.Leader() {
+		atomic.StoreInt32(&e.leader, 0)
+		if err := e.events.ReleaseLease(e.name, e.holder); err != nil {
+			log.Printf("elector: cannot release lease: %v", err)
+		}
+	}
+}
+
+// elect tries to acquire or renew the lease. On errors, the instance steps
+// down: it's better to miss an update than to run two schedulers.
+func (e *Elector) elect() {
+	ok, err := e.events.AcquireLease(e.name, e.holder, e.clock.Now(), e.ttl)
+	if err != nil {
+		log.Printf("elector: cannot acquire lease: %v", err)
+	}
+
+	var leader int32
+	if ok && err == nil {
+		leader = 1
+	}
+
+	if old := atomic.SwapInt32(&e.leader, leader); old != leader {
+		log.Printf("elector: %v is leader: %v", e.holder, leader == 1)
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"path"
+	"testing"
+	"time"
+)
+
+func TestRelayBroker(t *testing.T) {
+	name := path.Join(t.TempDir(), "db.sqlite3")
+	brokers := make([]*RelayBroker, 2)
+	for i := range brokers {
+		db, err := NewSqliteDatabase(name)
+		if err != nil {
+			t.Fatalf("NewSqliteDatabase() failed: %v", err)
+		}
+
+		brokers[i], err = NewRelayBroker(db.Events, "public", func() (Event, error) {
+			return NewEvent("", "snapshot"), nil
+		}, nil, Disconnect)
+		if err != nil {
+			t.Fatalf("NewRelayBroker() failed: %v", err)
+		}
+		defer brokers[i].Close(time.Second)
+	}
+
+	clients := make([]chan Event, len(brokers))
+	for i, b := range brokers {
+		clients[i], _ = b.Subscribe(0, Filter{})
+		defer b.Unsubscribe(clients[i])
+	}
+
+	brokers[0].Broadcast(NewEvent("notice", "hello"))
+	brokers[1].Broadcast(NewEvent("notice", "world"))
+
+	// Every instance sends the same events, with the same IDs.
+	for i, c := range clients {
+		for _, want := range []Event{{ID: 1, Type: "notice", Data: `"hello"`}, {ID: 2, Type: "notice", Data: `"world"`}} {
+			select {
+			case got := <-c:
+				if got.ID != want.ID || got.Data != want.Data {
+					t.Errorf("#%v: event = %v; got %v", i, want, got)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("#%v: event %v not received", i, want)
+			}
+		}
+	}
+}
+
+func TestRelayBrokerClosed(t *testing.T) {
+	db, err := NewSqliteDatabase(path.Join(t.TempDir(), "db.sqlite3"))
+	if err != nil {
+		t.Fatalf("NewSqliteDatabase() failed: %v", err)
+	}
+
+	b, err := NewRelayBroker(db.Events, "public", func() (Event, error) {
+		return NewEvent("", "snapshot"), nil
+	}, nil, Disconnect)
+	if err != nil {
+		t.Fatalf("NewRelayBroker() failed: %v", err)
+	}
+
+	b.Close(time.Second)
+	b.Broadcast(NewEvent("notice", "hello"))
+
+	// The event isn't published for other instances either.
+	if lastID, err := db.Events.LastID(); err != nil || lastID != 0 {
+		t.Errorf("events.LastID() = 0; got %v (%v)", lastID, err)
+	}
+}
+
+// receive returns the next event of a client, failing the test after a while.
+func receive(t *testing.T, name string, c chan Event) Event {
+	t.Helper()
+	select {
+	case e := <-c:
+		return e
+	case <-time.After(5 * time.Second):
+		t.Fatalf("%v: no event received", name)
+		return Event{}
+	}
+}
+
+func TestRelayedVersions(t *testing.T) {
+	name := path.Join(t.TempDir(), "db.sqlite3")
+	newStreams := func(beers []Beer) *Streams {
+		db, err := NewSqliteDatabase(name)
+		if err != nil {
+			t.Fatalf("NewSqliteDatabase() failed: %v", err)
+		}
+
+		s, err := NewStreams(beers, RelayBrokers(db.Events, Disconnect))
+		if err != nil {
+			t.Fatalf("NewStreams() failed: %v", err)
+		}
+		t.Cleanup(func() { s.Close(time.Second) })
+		return s
+	}
+
+	beers := []Beer{{ID: 1, BarID: 1, Name: "Bush", SellingPrice: 1}}
+	a := newStreams(beers)
+	clientA, _ := a.Public.Subscribe(0, Filter{})
+	defer a.Public.Unsubscribe(clientA)
+
+	beers[0].SellingPrice = 1.1
+	a.UpdateBeers(beers)
+	if e := receive(t, "a", clientA); e.ID != 1 || e.Version != 1 || e.Previous != 0 {
+		t.Fatalf("a: update = {id: 1, version: 1, previous: 0}; got %+v", e)
+	}
+
+	// b starts later, from the current state.
+	b := newStreams(beers)
+	clientB, _ := b.Public.Subscribe(0, Filter{})
+	defer b.Public.Unsubscribe(clientB)
+
+	// Versions are event IDs, but b doesn't know what its initial state
+	// follows.
+	beers[0].SellingPrice = 1.2
+	a.UpdateBeers(beers)
+	if e := receive(t, "a", clientA); e.ID != 2 || e.Version != 2 || e.Previous != 1 {
+		t.Errorf("a: update = {id: 2, version: 2, previous: 1}; got %+v", e)
+	}
+	if e := receive(t, "b", clientB); e.ID != 2 || e.Version != 2 || e.Previous != 0 {
+		t.Errorf("b: update = {id: 2, version: 2, previous: 0}; got %+v", e)
+	}
+
+	// From then on, both instances send the same updates.
+	beers[0].SellingPrice = 1.3
+	a.UpdateBeers(beers)
+	gotA, gotB := receive(t, "a", clientA), receive(t, "b", clientB)
+	if gotA.Payload() != gotB.Payload() || gotA.Version != 3 || gotA.Previous != 2 {
+		t.Errorf("updates = {version: 3, previous: 2}, same on both; got %v and %v", gotA.Payload(), gotB.Payload())
+	}
+
+	// A client of a resuming on b from before b started gets a snapshot.
+	c, r := b.Public.Subscribe(1, Filter{})
+	b.Public.Unsubscribe(c)
+	if r.ok {
+		t.Errorf("b.Subscribe(1) should not resume; got %+v", r)
+	}
+
+	// Otherwise, it gets the updates that follow its version.
+	c, r = b.Public.Subscribe(2, Filter{})
+	b.Public.Unsubscribe(c)
+	if !r.ok || len(r.missed) != 1 || r.missed[0].Previous != 2 {
+		t.Errorf("b.Subscribe(2) = [update following version 2]; got %+v", r)
+	}
+}
+
+func TestElector(t *testing.T) {
+	db, err := NewSqliteDatabase(path.Join(t.TempDir(), "db.sqlite3"))
+	if err != nil {
+		t.Fatalf("NewSqliteDatabase() failed: %v", err)
+	}
+
+	clock := newFakeClock(time.Unix(1000, 0))
+	a := NewElector(db.Events, clock, "scheduler", "a", 30*time.Second)
+	b := NewElector(db.Events, clock, "scheduler", "b", 30*time.Second)
+	a.Start()
+	b.Start()
+	defer b.Stop()
+	clock.WaitForSleeper()
+	clock.WaitForSleeper()
+
+	if !a.Leader() || b.Leader() {
+		t.Fatalf("a should be the only leader; got a: %v, b: %v", a.Leader(), b.Leader())
+	}
+
+	// When a stops, b takes over at its next attempt.
+	a.Stop()
+	clock.Advance(10 * time.Second)
+	clock.WaitForSleeper()
+
+	if a.Leader() || !b.Leader() {
+		t.Errorf("b should be the only leader; got a: %v, b: %v", a.Leader(), b.Leader())
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import "math"
+
+// Strategy computes the price of a beer for the next period, as NewPrice does.
+type Strategy func(b *Beer) float64
+
+// strategies lists the pricing strategies available for replays.
+var strategies = map[string]Strategy{
+	// The one actually used by the server.
+	"default": (*Beer).NewPrice,
+
+	// Beers are sold at their purchase price for the whole event.
+	"fixed": func(b *Beer) float64 {
+		return b.PurchasePrice
+	},
+}
+
+// Replay is the outcome of ReplayHistory. Profits are computed the same way
+// EstimatedProfit does.
+type Replay struct {
+	Beers            []BeerReplay `json:"beers"`
+	ActualProfit     float64      `json:"actualProfit"`
+	SimulatedProfit  float64      `json:"simulatedProfit"`
+	ProfitDifference float64      `json:"profitDifference"`
+}
+
+// BeerReplay is the outcome of a replay for a single beer. The i-th price of
+// each path is the one that was (or would have been) used during the i-th
+// recorded period.
+type BeerReplay struct {
+	ID               uint      `json:"id"`
+	Name             string    `json:"name"`
+	SoldQuantities   []int     `json:"soldQuantities"`
+	ActualPrices     []float64 `json:"actualPrices"`
+	SimulatedPrices  []float64 `json:"simulatedPrices"`
+	ActualProfit     float64   `json:"actualProfit"`
+	SimulatedProfit  float64   `json:"simulatedProfit"`
+	ProfitDifference float64   `json:"profitDifference"`
+}
+
+// ReplayHistory replays the recorded demand of an event against the given
+// beers' configuration and pricing strategy. Records must be sorted by period,
+// as returned by BeerManager.History, and are matched with beers by ID.
+//
+// Sold quantities are assumed to stay the same whatever the prices are, which
+// is obviously not true but still gives a good idea of the effects of a
+// configuration.
+func ReplayHistory(beers []Beer, history []Record, strategy Strategy) Replay {
+	records := map[uint][]Record{}
+	for _, r := range history {
+		records[r.BeerID] = append(records[r.BeerID], r)
+	}
+
+	replay := Replay{Beers: []BeerReplay{}}
+	for _, beer := range beers {
+		r := BeerReplay{
+			ID:              beer.ID,
+			Name:            beer.Name,
+			SoldQuantities:  []int{},
+			ActualPrices:    []float64{},
+			SimulatedPrices: []float64{},
+		}
+
+		b := beer
+		b.SellingPrice = b.PurchasePrice
+		b.SoldQuantity = 0
+		b.ConsecutiveRises = 0
+		for _, record := range records[beer.ID] {
+			b.PreviousSoldQuantity = b.SoldQuantity
+			b.SoldQuantity = record.SoldQuantity
+
+			r.SoldQuantities = append(r.SoldQuantities, record.SoldQuantity)
+			r.ActualPrices = append(r.ActualPrices, record.SellingPrice)
+			r.SimulatedPrices = append(r.SimulatedPrices, b.SellingPrice)
+			r.ActualProfit += profit(record.SoldQuantity, record.SellingPrice, b.PurchasePrice)
+			r.SimulatedProfit += profit(record.SoldQuantity, b.SellingPrice, b.PurchasePrice)
+
+			price := strategy(&b)
+			if price > b.SellingPrice {
+				b.ConsecutiveRises++
+			} else {
+				b.ConsecutiveRises = 0
+			}
+			b.SellingPrice = price
+		}
+
+		r.ProfitDifference = r.SimulatedProfit - r.ActualProfit
+		replay.Beers = append(replay.Beers, r)
+		replay.ActualProfit += r.ActualProfit
+		replay.SimulatedProfit += r.SimulatedProfit
+	}
+
+	replay.ProfitDifference = replay.SimulatedProfit - replay.ActualProfit
+	return replay
+}
+
+// ApplyConfig overrides the pricing configuration (coefficients and
+// guardrails) of beers with the one of same-named beers from configs. Other
+// beers are left as is.
+func ApplyConfig(beers []Beer, configs []Beer) {
+	byName := map[string]Beer{}
+	for _, c := range configs {
+		byName[c.Name] = c
+	}
+
+	for i := range beers {
+		c, ok := byName[beers[i].Name]
+		if !ok {
+			continue
+		}
+
+		beers[i].IncrCoef = c.IncrCoef
+		beers[i].DecrCoef = c.DecrCoef
+		beers[i].MinCoef = c.MinCoef
+		beers[i].MaxCoef = c.MaxCoef
+		beers[i].MaxIncrease = c.MaxIncrease
+		beers[i].MaxDecrease = c.MaxDecrease
+		beers[i].MaxIncreaseRate = c.MaxIncreaseRate
+		beers[i].MaxDecreaseRate = c.MaxDecreaseRate
+		beers[i].MaxRises = c.MaxRises
+	}
+}
+
+// profit computes the profit made on sold beers. Prices are rounded to the
+// tenth as customers pay them.
+func profit(quantity int, sellingPrice, purchasePrice float64) float64 {
+	return float64(quantity) * (math.Round(sellingPrice*10)/10 - purchasePrice)
+}
@@ -0,0 +1,103 @@
+package main
+
+import "testing"
+
+func TestReplayHistory(t *testing.T) {
+	beers := []Beer{
+		{ID: 1, Name: "Bush", PurchasePrice: 1, IncrCoef: 0.1, DecrCoef: 0.1, MinCoef: 0.5, MaxCoef: 2},
+		{ID: 2, Name: "TK", PurchasePrice: 2, IncrCoef: 0.1, DecrCoef: 0.1, MinCoef: 0.5, MaxCoef: 2},
+	}
+	history := []Record{
+		{BeerID: 1, SoldQuantity: 2, SellingPrice: 1},
+		{BeerID: 1, SoldQuantity: 5, SellingPrice: 1.5},
+		{BeerID: 1, SoldQuantity: 1, SellingPrice: 1.5},
+		{BeerID: 2, SoldQuantity: 4, SellingPrice: 2},
+	}
+
+	tests := []struct {
+		strategy string
+		prices   []float64
+		profit   float64
+	}{
+		{
+			strategy: "default",
+			prices:   []float64{1, 1.2, 1.5},
+			profit:   1.5, // 2×0 + 5×0.2 + 1×0.5 for Bush, 4×0 for TK
+		},
+		{
+			strategy: "fixed",
+			prices:   []float64{1, 1, 1},
+			profit:   0,
+		},
+	}
+
+	for _, test := range tests {
+		got := ReplayHistory(beers, history, strategies[test.strategy])
+
+		prices := got.Beers[0].SimulatedPrices
+		if len(prices) != len(test.prices) {
+			t.Fatalf("len(replay.Beers[0].SimulatedPrices) = %v; got %v", len(test.prices), len(prices))
+		}
+		for i, want := range test.prices {
+			if prices[i] < want-1e-3 || prices[i] > want+1e-3 {
+				t.Errorf("replay.Beers[0].SimulatedPrices[%v] = %v; got %v", i, want, prices[i])
+			}
+		}
+
+		if got.SimulatedProfit < test.profit-1e-3 || got.SimulatedProfit > test.profit+1e-3 {
+			t.Errorf("replay.SimulatedProfit = %v; got %v", test.profit, got.SimulatedProfit)
+		}
+
+		actual := 3.0 // 2×0 + 5×0.5 + 1×0.5 for Bush, 4×0 for TK
+		if got.ActualProfit < actual-1e-3 || got.ActualProfit > actual+1e-3 {
+			t.Errorf("replay.ActualProfit = %v; got %v", actual, got.ActualProfit)
+		}
+	}
+}
+
+func TestReplayMaxRises(t *testing.T) {
+	beers := []Beer{
+		{ID: 1, Name: "Bush", PurchasePrice: 1, IncrCoef: 0.1, DecrCoef: 0.1, MinCoef: 0.5, MaxCoef: 10, MaxRises: 2},
+		{ID: 2, Name: "TK", PurchasePrice: 1, IncrCoef: 0.1, DecrCoef: 0.1, MinCoef: 0.5, MaxCoef: 10},
+	}
+
+	// Bush's sales keep growing, TK's don't.
+	history := []Record{}
+	for i := 0; i < 8; i++ {
+		history = append(history, Record{BeerID: 1, Period: int64(i), SoldQuantity: 10 * (i + 1)})
+	}
+	for i := 0; i < 8; i++ {
+		history = append(history, Record{BeerID: 2, Period: int64(i), SoldQuantity: 5})
+	}
+
+	// Bush's price rises twice in a row at most, then pauses for a period.
+	got := ReplayHistory(beers, history, strategies["default"]).Beers[0].SimulatedPrices
+	want := []float64{1, 2, 3, 3, 4, 5, 5, 6}
+	if len(got) != len(want) {
+		t.Fatalf("len(replay.Beers[0].SimulatedPrices) = %v; got %v", len(want), len(got))
+	}
+	for i := range want {
+		if got[i] < want[i]-1e-3 || got[i] > want[i]+1e-3 {
+			t.Errorf("replay.Beers[0].SimulatedPrices = %v; got %v", want, got)
+			break
+		}
+	}
+}
+
+func TestApplyConfig(t *testing.T) {
+	beers := []Beer{
+		{ID: 1, Name: "Bush", StockQuantity: 24, IncrCoef: 0.1},
+		{ID: 2, Name: "TK", StockQuantity: 48, IncrCoef: 0.1},
+	}
+	ApplyConfig(beers, []Beer{{Name: "TK", StockQuantity: 1, IncrCoef: 0.5, MaxCoef: 3}})
+
+	if beers[0].IncrCoef != 0.1 {
+		t.Errorf("beers[0].IncrCoef = 0.1; got %v", beers[0].IncrCoef)
+	}
+	if beers[1].IncrCoef != 0.5 || beers[1].MaxCoef != 3 {
+		t.Errorf("beers[1] coefficients = 0.5, 3; got %v, %v", beers[1].IncrCoef, beers[1].MaxCoef)
+	}
+	if beers[1].StockQuantity != 48 {
+		t.Errorf("beers[1].StockQuantity = 48; got %v", beers[1].StockQuantity)
+	}
+}
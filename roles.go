@@ -0,0 +1,110 @@
+package main
+
+// Role is what a user does during the event, which determines what they are
+// allowed to do.
+type Role string
+
+const (
+	// RoleAdmin can do anything.
+	RoleAdmin Role = "admin"
+
+	// RoleTreasurer can read statistics and analyze prices, but cannot order
+	// beers nor manage users.
+	RoleTreasurer Role = "treasurer"
+
+	// RoleCashier can order beers.
+	RoleCashier Role = "cashier"
+
+	// RoleBartender can order beers.
+	RoleBartender Role = "bartender"
+
+	// RoleDisplay can only read events, e.g. for a screen behind the bar.
+	RoleDisplay Role = "display"
+)
+
+// Permission is something a user may be allowed to do.
+type Permission string
+
+const (
+	// PermOrder lets users order beers, from their bars if they have any.
+	PermOrder Permission = "order"
+
+	// PermStaffEvents lets users get staff events.
+	PermStaffEvents Permission = "staff_events"
+
+	// PermStats lets users get statistics, replay sales and tune prices.
+	PermStats Permission = "stats"
+
+	// PermManageBeers lets users import beers.
+	PermManageBeers Permission = "manage_beers"
+
+	// PermManageUsers lets users manage everyone's accounts, terminals and API
+	// keys.
+	PermManageUsers Permission = "manage_users"
+
+	// PermNotify lets users send notices to the staff.
+	PermNotify Permission = "notify"
+
+	// PermAudit lets users read the audit log.
+	PermAudit Permission = "audit"
+
+	// PermAccount lets users manage their own account (name, password and
+	// tokens). It isn't given to API keys.
+	PermAccount Permission = "account"
+)
+
+// rolePermissions gives the permissions of every role. Admins have all of
+// them.
+var rolePermissions = map[Role][]Permission{
+	RoleTreasurer: {PermAccount, PermStaffEvents, PermStats},
+	RoleCashier:   {PermAccount, PermOrder, PermStaffEvents},
+	RoleBartender: {PermAccount, PermOrder, PermStaffEvents},
+	RoleDisplay:   {PermAccount, PermStaffEvents},
+}
+
+// Valid tells if a role exists.
+func (r Role) Valid() bool {
+	_, ok := rolePermissions[r]
+	return ok || r == RoleAdmin
+}
+
+// Can tells if a role has a permission.
+func (r Role) Can(p Permission) bool {
+	if r == RoleAdmin {
+		return true
+	}
+
+	for _, perm := range rolePermissions[r] {
+		if perm == p {
+			return true
+		}
+	}
+	return false
+}
+
+// Scope is something an API key is allowed to do.
+type Scope string
+
+// Scopes grant a single permission each (see scopePermissions).
+const (
+	ScopeReadEvents Scope = "read-events"
+	ScopeOrder      Scope = "order"
+	ScopeStats      Scope = "stats"
+)
+
+// scopePermissions gives the permission every scope grants.
+var scopePermissions = map[Scope]Permission{
+	ScopeReadEvents: PermStaffEvents,
+	ScopeOrder:      PermOrder,
+	ScopeStats:      PermStats,
+}
+
+// Can tells if one of an API key's scopes grants a permission.
+func (k APIKey) Can(p Permission) bool {
+	for _, scope := range k.Scopes {
+		if scopePermissions[scope] == p {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,50 @@
+package main
+
+import "testing"
+
+func TestRoleCan(t *testing.T) {
+	tests := []struct {
+		role Role
+		perm Permission
+		want bool
+	}{
+		{RoleAdmin, PermManageUsers, true},
+		{RoleTreasurer, PermStats, true},
+		{RoleTreasurer, PermOrder, false},
+		{RoleTreasurer, PermManageUsers, false},
+		{RoleCashier, PermOrder, true},
+		{RoleBartender, PermOrder, true},
+		{RoleBartender, PermStats, false},
+		{RoleDisplay, PermStaffEvents, true},
+		{RoleDisplay, PermOrder, false},
+		{RoleDisplay, PermAccount, true},
+		{Role("janitor"), PermStaffEvents, false},
+	}
+
+	for _, test := range tests {
+		if got := test.role.Can(test.perm); got != test.want {
+			t.Errorf("%v.Can(%v) = %v; got %v", test.role, test.perm, test.want, got)
+		}
+	}
+}
+
+func TestAPIKeyCan(t *testing.T) {
+	key := APIKey{Scopes: []Scope{ScopeReadEvents, ScopeOrder}}
+
+	tests := []struct {
+		perm Permission
+		want bool
+	}{
+		{PermStaffEvents, true},
+		{PermOrder, true},
+		{PermStats, false},
+		{PermAccount, false},
+		{PermManageUsers, false},
+	}
+
+	for _, test := range tests {
+		if got := key.Can(test.perm); got != test.want {
+			t.Errorf("key.Can(%v) = %v; got %v", test.perm, test.want, got)
+		}
+	}
+}
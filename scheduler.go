@@ -0,0 +1,260 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// CatchUp tells a Scheduler what to do with periods that were missed while
+// the server was down.
+type CatchUp string
+
+const (
+	// CatchUpNone only records missed periods and waits for the next one.
+	CatchUpNone CatchUp = "none"
+
+	// CatchUpOnce updates prices once at startup, whatever the number of
+	// missed periods.
+	CatchUpOnce CatchUp = "once"
+
+	// CatchUpAll updates prices once per missed period at startup.
+	CatchUpAll CatchUp = "all"
+)
+
+// Scheduler updates beer prices at the start of every period. Failed updates
+// are retried with an exponential backoff and, if they still fail, reported
+// instead of crashing the server.
+//
+// Once created with NewScheduler, use Run to start it, Status to know how it
+// is doing and Stop to stop it.
+type Scheduler struct {
+	beers    BeerManager
+	clock    Clock
+	leader   func() bool
+	updated  func(beers []Beer)
+	period   time.Duration
+	catchUp  CatchUp
+	retries  int
+	backoff  time.Duration
+	statusMu sync.Mutex
+	status   SchedulerStatus
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+// SchedulerStatus reports what a Scheduler has been doing.
+type SchedulerStatus struct {
+	LastUpdate    time.Time   `json:"lastUpdate"`
+	Failures      int         `json:"failures"`
+	LastError     string      `json:"lastError,omitempty"`
+	MissedPeriods []time.Time `json:"missedPeriods"`
+}
+
+// NewScheduler creates a scheduler that updates beers' prices every period
+// and then calls updated with the new beers.
+//
+// When several server instances run, leader tells if the current one should
+// update prices (see Elector). If nil, it always does.
+func NewScheduler(beers BeerManager, clock Clock, period time.Duration, catchUp CatchUp, leader func() bool, updated func(beers []Beer)) *Scheduler {
+	return &Scheduler{
+		beers:   beers,
+		clock:   clock,
+		leader:  leader,
+		updated: updated,
+		period:  period,
+		catchUp: catchUp,
+		retries: 5,
+		backoff: time.Second,
+		status:  SchedulerStatus{MissedPeriods: []time.Time{}},
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+}
+
+// Run catches up with missed periods and then updates prices at the start of
+// every period, until Stop is called. It should be run in its own goroutine.
+func (s *Scheduler) Run() {
+	defer close(s.done)
+	s.catchUpMissedPeriods()
+
+	for {
+		now := s.clock.Now()
+		next := s.boundary(now).Add(s.period)
+		select {
+		case <-s.clock.After(next.Sub(now)):
+			s.tick(next)
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+// Stop stops a running scheduler. It waits for the current update, if any,
+// to complete but doesn't retry it if it fails.
+func (s *Scheduler) Stop() {
+	close(s.stop)
+	<-s.done
+}
+
+// Current returns the period that is currently running.
+func (s *Scheduler) Current() Period {
+	now := s.clock.Now()
+	return Period{Number: s.number(now), Timestamp: now}
+}
+
+// Status returns a copy of the scheduler's current status.
+func (s *Scheduler) Status() SchedulerStatus {
+	s.statusMu.Lock()
+	defer s.statusMu.Unlock()
+
+	status := s.status
+	status.MissedPeriods = append([]time.Time{}, s.status.MissedPeriods...)
+	return status
+}
+
+// number returns the number of the period containing t. Periods are aligned
+// on the Unix epoch.
+func (s *Scheduler) number(t time.Time) int64 {
+	return t.UnixMilli() / s.period.Milliseconds()
+}
+
+// boundary returns the start of the period containing t.
+func (s *Scheduler) boundary(t time.Time) time.Time {
+	return time.UnixMilli(s.number(t) * s.period.Milliseconds())
+}
+
+// missedPeriods returns the start of every period that began after last and
+// not after now.
+func (s *Scheduler) missedPeriods(last, now time.Time) []time.Time {
+	missed := []time.Time{}
+	for t := s.boundary(last).Add(s.period); !t.After(now); t = t.Add(s.period) {
+		missed = append(missed, t)
+	}
+	return missed
+}
+
+// catchUpMissedPeriods detects the periods that were missed since the last
+// price update and, depending on the catch-up policy, applies them. It's up
+// to the leader to do so.
+func (s *Scheduler) catchUpMissedPeriods() {
+	if !s.isLeader() {
+		return
+	}
+
+	last, err := s.beers.LastUpdate()
+	if err != nil {
+		log.Printf("scheduler: cannot detect missed periods: %v", err)
+		s.report(err)
+		return
+	}
+	if last.IsZero() {
+		return // nothing happened yet
+	}
+
+	missed := s.missedPeriods(last, s.clock.Now())
+	if len(missed) == 0 {
+		return
+	}
+
+	log.Printf("scheduler: %v period(s) missed since %v, catch-up policy is %q", len(missed), last, s.catchUp)
+	switch s.catchUp {
+	case CatchUpOnce:
+		s.tick(missed[len(missed)-1])
+		missed = missed[:len(missed)-1]
+	case CatchUpAll:
+		for _, t := range missed {
+			s.tick(t)
+		}
+		missed = nil
+	}
+
+	s.statusMu.Lock()
+	s.status.MissedPeriods = append(s.status.MissedPeriods, missed...)
+	s.statusMu.Unlock()
+}
+
+// tick updates prices for the period starting at t, retrying on failure. It
+// does nothing if another instance is the leader.
+func (s *Scheduler) tick(t time.Time) {
+	if !s.isLeader() {
+		return
+	}
+
+	p := Period{Number: s.number(t), Timestamp: t}
+	backoff := s.backoff
+	priced := false
+	for attempt := 0; ; attempt++ {
+		err := s.update(p, &priced)
+		if err == nil {
+			s.statusMu.Lock()
+			s.status.LastUpdate = t
+			s.statusMu.Unlock()
+			return
+		}
+
+		if attempt == s.retries {
+			s.fail(t, err)
+			return
+		}
+
+		log.Printf("scheduler: update of period %v failed (attempt %v): %v", t, attempt+1, err)
+		select {
+		case <-s.clock.After(backoff):
+		case <-s.stop:
+			s.fail(t, err)
+			return
+		}
+		backoff *= 2
+	}
+}
+
+// isLeader tells if the current instance should update prices.
+func (s *Scheduler) isLeader() bool {
+	return s.leader == nil || s.leader()
+}
+
+// update updates all prices for a period, unless priced tells it was already
+// done by a previous attempt, and then broadcasts them. Panics are recovered
+// and returned as errors.
+func (s *Scheduler) update(p Period, priced *bool) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+
+	if !*priced {
+		if err := s.beers.UpdatePrices(p); err != nil {
+			return err
+		}
+		*priced = true
+	}
+
+	beers, err := s.beers.All()
+	if err != nil {
+		return err
+	}
+
+	s.updated(beers)
+	return nil
+}
+
+// fail reports that the period starting at t could not be updated.
+func (s *Scheduler) fail(t time.Time, err error) {
+	log.Printf("scheduler: period %v missed: %v", t, err)
+	s.report(err)
+
+	s.statusMu.Lock()
+	defer s.statusMu.Unlock()
+	s.status.MissedPeriods = append(s.status.MissedPeriods, t)
+}
+
+// report records an error in the scheduler's status.
+func (s *Scheduler) report(err error) {
+	s.statusMu.Lock()
+	defer s.statusMu.Unlock()
+	s.status.Failures++
+	s.status.LastError = err.Error()
+}
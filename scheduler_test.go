@@ -0,0 +1,290 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"path"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// stubBeerManager is a BeerManager whose price updates, and then listings,
+// fail a given number of times before succeeding. If release is set, updates
+// signal on updating and wait for release before doing anything.
+type stubBeerManager struct {
+	BeerManager
+	failures    int
+	allFailures int
+	updates     int
+	last        time.Time
+	updating    chan struct{}
+	release     chan struct{}
+}
+
+func (m *stubBeerManager) UpdatePrices(p Period) error {
+	if m.release != nil {
+		m.updating <- struct{}{}
+		<-m.release
+	}
+	if m.failures > 0 {
+		m.failures--
+		return errors.New("database is locked")
+	}
+	m.updates++
+	return nil
+}
+
+func (m *stubBeerManager) All() ([]Beer, error) {
+	if m.allFailures > 0 {
+		m.allFailures--
+		return nil, errors.New("database is locked")
+	}
+	return []Beer{}, nil
+}
+
+func (m *stubBeerManager) LastUpdate() (time.Time, error) {
+	return m.last, nil
+}
+
+func newTestScheduler(beers BeerManager, catchUp CatchUp) *Scheduler {
+	s := NewScheduler(beers, systemClock{}, 15*time.Minute, catchUp, nil, func([]Beer) {})
+	s.backoff = time.Millisecond
+	return s
+}
+
+// fakeClock is a Clock whose time only moves forward when told to.
+type fakeClock struct {
+	mu       sync.Mutex
+	now      time.Time
+	timers   []fakeTimer
+	sleeping chan struct{}
+}
+
+type fakeTimer struct {
+	at time.Time
+	c  chan time.Time
+}
+
+func newFakeClock(now time.Time) *fakeClock {
+	return &fakeClock{now: now, sleeping: make(chan struct{}, 16)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	timer := fakeTimer{c.now.Add(d), make(chan time.Time, 1)}
+	c.timers = append(c.timers, timer)
+	c.sleeping <- struct{}{}
+	return timer.c
+}
+
+// Advance moves the time forward, waking up timers that expire.
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.now = c.now.Add(d)
+	timers := c.timers[:0]
+	for _, timer := range c.timers {
+		if timer.at.After(c.now) {
+			timers = append(timers, timer)
+		} else {
+			timer.c <- c.now
+		}
+	}
+	c.timers = timers
+}
+
+// WaitForSleeper blocks until someone waits on the clock.
+func (c *fakeClock) WaitForSleeper() {
+	<-c.sleeping
+}
+
+func TestSchedulerDrivesPeriods(t *testing.T) {
+	db, err := NewSqliteDatabase(path.Join(t.TempDir(), "db.sqlite3"))
+	if err != nil {
+		t.Fatalf("NewSqliteDatabase() failed: %v", err)
+	}
+
+	period := 15 * time.Minute
+	clock := newFakeClock(time.Unix(0, 0).Add(10*period + 5*time.Minute))
+	updated := make(chan []Beer)
+	s := NewScheduler(db.Beers, clock, period, CatchUpNone, nil, func(beers []Beer) {
+		updated <- beers
+	})
+
+	beer := Beer{Name: "Bush", PurchasePrice: 1, IncrCoef: 0.1, DecrCoef: 0.1, MinCoef: 0.5, MaxCoef: 2}
+	if err := db.Beers.Create(&beer, s.Current()); err != nil {
+		t.Fatalf("beers.Create() failed: %v", err)
+	}
+
+	go s.Run()
+
+	for _, quantity := range []int{3, 5, 1} {
+		if err := db.Beers.MakeOrder(beer.ID, quantity); err != nil {
+			t.Fatalf("beers.MakeOrder() failed: %v", err)
+		}
+
+		clock.WaitForSleeper()
+		clock.Advance(period)
+		<-updated
+	}
+
+	history, err := db.Beers.History()
+	if err != nil {
+		t.Fatalf("beers.History() failed: %v", err)
+	}
+
+	want := []Record{
+		{BeerID: 1, Period: 10, SoldQuantity: 3, SellingPrice: 1},
+		{BeerID: 1, Period: 11, SoldQuantity: 5, SellingPrice: 1.3},
+		{BeerID: 1, Period: 12, SoldQuantity: 1, SellingPrice: 1.5},
+		{BeerID: 1, Period: 13, SoldQuantity: 0, SellingPrice: 1.1},
+	}
+	if len(history) != len(want) {
+		t.Fatalf("beers.History() = %v; got %v", want, history)
+	}
+	for i := range want {
+		got := history[i]
+		if got.Period != want[i].Period || got.SoldQuantity != want[i].SoldQuantity || math.Abs(got.SellingPrice-want[i].SellingPrice) > 1e-3 {
+			t.Errorf("beers.History()[%v] = %v; got %v", i, want[i], got)
+		}
+	}
+
+	last, err := db.Beers.LastUpdate()
+	if err != nil {
+		t.Fatalf("beers.LastUpdate() failed: %v", err)
+	}
+	if !last.Equal(time.Unix(0, 0).Add(13 * period)) {
+		t.Errorf("beers.LastUpdate() = %v; got %v", time.Unix(0, 0).Add(13*period), last)
+	}
+}
+
+func TestMissedPeriods(t *testing.T) {
+	s := newTestScheduler(&stubBeerManager{}, CatchUpNone)
+	start := time.Unix(0, 0)
+
+	tests := []struct {
+		last, now time.Time
+		want      []time.Time
+	}{
+		{start, start.Add(14 * time.Minute), []time.Time{}},
+		{start.Add(5 * time.Minute), start.Add(15 * time.Minute), []time.Time{start.Add(15 * time.Minute)}},
+		{start, start.Add(31 * time.Minute), []time.Time{start.Add(15 * time.Minute), start.Add(30 * time.Minute)}},
+	}
+
+	for _, test := range tests {
+		got := s.missedPeriods(test.last, test.now)
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("s.missedPeriods(%v, %v) = %v; got %v", test.last, test.now, test.want, got)
+		}
+	}
+}
+
+func TestSchedulerRetries(t *testing.T) {
+	beers := &stubBeerManager{failures: 2}
+	s := newTestScheduler(beers, CatchUpNone)
+	s.tick(time.Unix(900, 0))
+
+	if beers.updates != 1 {
+		t.Errorf("beers.updates = 1; got %v", beers.updates)
+	}
+
+	status := s.Status()
+	if status.Failures != 0 || len(status.MissedPeriods) != 0 || !status.LastUpdate.Equal(time.Unix(900, 0)) {
+		t.Errorf("s.Status() = {LastUpdate: 900, Failures: 0}; got %+v", status)
+	}
+}
+
+func TestSchedulerRetriesBroadcast(t *testing.T) {
+	beers := &stubBeerManager{allFailures: 1}
+	broadcasts := 0
+	s := NewScheduler(beers, systemClock{}, 15*time.Minute, CatchUpNone, nil, func([]Beer) { broadcasts++ })
+	s.backoff = time.Millisecond
+	s.tick(time.Unix(900, 0))
+
+	// Prices were updated once, even though listing beers had to be retried.
+	if beers.updates != 1 || broadcasts != 1 {
+		t.Errorf("beers.updates, broadcasts = 1, 1; got %v, %v", beers.updates, broadcasts)
+	}
+	if status := s.Status(); len(status.MissedPeriods) != 0 {
+		t.Errorf("s.Status().MissedPeriods = []; got %v", status.MissedPeriods)
+	}
+}
+
+func TestSchedulerGivesUp(t *testing.T) {
+	beers := &stubBeerManager{failures: 100}
+	s := newTestScheduler(beers, CatchUpNone)
+	s.tick(time.Unix(900, 0))
+
+	status := s.Status()
+	if status.Failures != 1 || !reflect.DeepEqual(status.MissedPeriods, []time.Time{time.Unix(900, 0)}) {
+		t.Errorf("s.Status() = {Failures: 1, MissedPeriods: [900]}; got %+v", status)
+	}
+}
+
+func TestSchedulerCatchUp(t *testing.T) {
+	tests := []struct {
+		catchUp CatchUp
+		updates int
+		missed  int
+	}{
+		{CatchUpNone, 0, 3},
+		{CatchUpOnce, 1, 2},
+		{CatchUpAll, 3, 0},
+	}
+
+	// Some time into a period, so that the last update was 3 periods ago.
+	now := time.Unix(0, 0).Add(100*15*time.Minute + 7*time.Minute)
+	for _, test := range tests {
+		beers := &stubBeerManager{last: now.Add(-45 * time.Minute)}
+		s := NewScheduler(beers, newFakeClock(now), 15*time.Minute, test.catchUp, nil, func([]Beer) {})
+		s.catchUpMissedPeriods()
+
+		if beers.updates != test.updates {
+			t.Errorf("%v: beers.updates = %v; got %v", test.catchUp, test.updates, beers.updates)
+		}
+		if missed := len(s.Status().MissedPeriods); missed != test.missed {
+			t.Errorf("%v: len(s.Status().MissedPeriods) = %v; got %v", test.catchUp, test.missed, missed)
+		}
+	}
+}
+
+func TestSchedulerStopWaitsForUpdate(t *testing.T) {
+	beers := &stubBeerManager{updating: make(chan struct{}), release: make(chan struct{})}
+	clock := newFakeClock(time.Unix(0, 0))
+	s := NewScheduler(beers, clock, 15*time.Minute, CatchUpNone, nil, func([]Beer) {})
+	go s.Run()
+
+	clock.WaitForSleeper()
+	clock.Advance(15 * time.Minute)
+	<-beers.updating
+
+	stopped := make(chan struct{})
+	go func() {
+		s.Stop()
+		close(stopped)
+	}()
+
+	select {
+	case <-stopped:
+		t.Fatal("s.Stop() returned before the update completed")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(beers.release)
+	<-stopped
+
+	if beers.updates != 1 {
+		t.Errorf("beers.updates = 1; got %v", beers.updates)
+	}
+}
@@ -0,0 +1,45 @@
+-- name: api-keys/get-all
+SELECT
+	id,
+	name,
+	scopes,
+	created,
+	COALESCE(expires, 0),
+	(SELECT GROUP_CONCAT(bar_id) FROM (SELECT bar_id FROM api_key_bars WHERE api_key_id = api_keys.id ORDER BY bar_id))
+FROM
+	api_keys
+ORDER BY
+	id
+
+-- name: api-keys/get-by-key
+SELECT
+	id,
+	name,
+	scopes,
+	created,
+	COALESCE(expires, 0),
+	(SELECT GROUP_CONCAT(bar_id) FROM (SELECT bar_id FROM api_key_bars WHERE api_key_id = api_keys.id ORDER BY bar_id))
+FROM
+	api_keys
+WHERE
+	hash = ?1
+	AND (expires IS NULL OR expires > ?2)
+
+-- name: api-keys/create
+INSERT INTO
+	api_keys(name, hash, scopes, created, expires)
+VALUES
+	(?1, ?2, ?3, ?4, NULLIF(?5, 0))
+
+-- name: api-keys/add-bar
+INSERT INTO
+	api_key_bars(api_key_id, bar_id)
+VALUES
+	(?1, ?2)
+ON CONFLICT DO NOTHING
+
+-- name: api-keys/delete
+DELETE FROM
+	api_keys
+WHERE
+	id = ?1
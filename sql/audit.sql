@@ -0,0 +1,34 @@
+-- name: audit/record
+INSERT INTO
+	audit(timestamp, actor_id, action, target, summary, ip)
+VALUES
+	(?1, NULLIF(?2, 0), ?3, ?4, ?5, ?6)
+
+-- name: audit/get
+-- Entries are filtered by actor, comma-separated actions, target and time
+-- range, unless the corresponding parameter is zero or empty, and paginated
+-- by ID, most recent first.
+SELECT
+	a.id,
+	a.timestamp,
+	COALESCE(a.actor_id, 0),
+	COALESCE(u.name, ''),
+	a.action,
+	a.target,
+	a.summary,
+	a.ip
+FROM
+	audit AS a
+LEFT JOIN
+	users AS u ON u.id = a.actor_id
+WHERE
+	(?1 = 0 OR a.actor_id = ?1)
+	AND (?2 = '' OR INSTR(',' || ?2 || ',', ',' || a.action || ',') > 0)
+	AND (?3 = '' OR a.target = ?3)
+	AND (?4 = 0 OR a.timestamp >= ?4)
+	AND (?5 = 0 OR a.timestamp < ?5)
+	AND (?6 = 0 OR a.id < ?6)
+ORDER BY
+	a.id DESC
+LIMIT
+	?7
@@ -6,7 +6,7 @@ WITH
 			sold_quantity,
 			selling_price,
 			SUM(sold_quantity) AS total_sold_quantity,
-			MAX(timestamp) AS most_recent_timestamp
+			MAX(period) AS most_recent_period
 		FROM
 			history
 		GROUP BY
@@ -17,13 +17,13 @@ WITH
 			h.beer_id,
 			h.sold_quantity,
 			h.selling_price,
-			MAX(h.timestamp) AS second_most_recent_timestamp
+			MAX(h.period) AS second_most_recent_period
 		FROM
 			history AS h
 		INNER JOIN
 			h1 USING (beer_id)
 		WHERE
-			h.timestamp < h1.most_recent_timestamp
+			h.period < h1.most_recent_period
 		GROUP BY
 			h.beer_id
 	)
@@ -43,7 +43,12 @@ SELECT
 	b.incr_coef,
 	b.decr_coef,
 	b.min_coef,
-	b.max_coef
+	b.max_coef,
+	b.max_increase,
+	b.max_decrease,
+	b.max_increase_rate,
+	b.max_decrease_rate,
+	b.max_rises
 FROM
 	beers AS b
 LEFT JOIN
@@ -53,9 +58,9 @@ LEFT JOIN
 
 -- name: beers/create
 INSERT INTO
-	beers(bar_id, name, stock_quantity, purchase_price, bottle_size, alcohol_content, incr_coef, decr_coef, min_coef, max_coef)
+	beers(bar_id, name, stock_quantity, purchase_price, bottle_size, alcohol_content, incr_coef, decr_coef, min_coef, max_coef, max_increase, max_decrease, max_increase_rate, max_decrease_rate, max_rises)
 VALUES
-	(?1, ?2, ?3, ?4, ?5, ?6, ?7, ?8, ?9, ?10)
+	(?1, ?2, ?3, ?4, ?5, ?6, ?7, ?8, ?9, ?10, ?11, ?12, ?13, ?14, ?15)
 
 -- name: beers/delete-all
 DELETE FROM
@@ -76,10 +81,40 @@ SET
 	sold_quantity = sold_quantity + ?2
 WHERE
 	beer_id = ?1
-	AND timestamp = (SELECT MAX(timestamp) FROM history WHERE beer_id = ?1)
+	AND period = (SELECT MAX(period) FROM history WHERE beer_id = ?1)
 
 -- name: beers/update-price
 INSERT INTO
-	history(beer_id, sold_quantity, selling_price)
+	history(beer_id, period, timestamp, sold_quantity, selling_price)
 VALUES
-	(?1, 0, ?2)
+	(?1, ?3, ?4, 0, ?2)
+
+-- name: beers/get-history
+SELECT
+	beer_id,
+	period,
+	sold_quantity,
+	selling_price
+FROM
+	history
+ORDER BY
+	beer_id,
+	period
+
+-- name: beers/get-last-update
+SELECT
+	MAX(timestamp)
+FROM
+	history
+
+-- name: beers/create-order
+INSERT INTO
+	orders(user_id, timestamp)
+VALUES
+	(NULLIF(?1, 0), ?2)
+
+-- name: beers/create-order-line
+INSERT INTO
+	order_lines(order_id, beer_id, quantity)
+VALUES
+	(?1, ?2, ?3)
@@ -0,0 +1,48 @@
+-- name: events/publish
+INSERT INTO
+	events(channel, data, timestamp)
+VALUES
+	(?1, ?2, ?3)
+
+-- name: events/get-since
+SELECT
+	id,
+	data
+FROM
+	events
+WHERE
+	channel = ?1
+	AND id > ?2
+ORDER BY
+	id
+
+-- name: events/get-last-id
+SELECT
+	COALESCE(MAX(id), 0)
+FROM
+	events
+
+-- name: events/delete-old
+DELETE FROM
+	events
+WHERE
+	timestamp < ?1
+
+-- name: leases/acquire
+INSERT INTO
+	leases(name, holder, expires)
+VALUES
+	(?1, ?2, ?4)
+ON CONFLICT (name) DO UPDATE SET
+	holder = excluded.holder,
+	expires = excluded.expires
+WHERE
+	leases.holder = excluded.holder
+	OR leases.expires < ?3
+
+-- name: leases/release
+DELETE FROM
+	leases
+WHERE
+	name = ?1
+	AND holder = ?2
@@ -0,0 +1,187 @@
+-- name: migrations/1
+ALTER TABLE beers ADD COLUMN max_increase REAL NOT NULL DEFAULT 0;
+ALTER TABLE beers ADD COLUMN max_decrease REAL NOT NULL DEFAULT 0;
+ALTER TABLE beers ADD COLUMN max_increase_rate REAL NOT NULL DEFAULT 0;
+ALTER TABLE beers ADD COLUMN max_decrease_rate REAL NOT NULL DEFAULT 0;
+ALTER TABLE beers ADD COLUMN max_rises INTEGER NOT NULL DEFAULT 0;
+
+-- name: migrations/2
+-- Timestamps become Unix milliseconds set by the server, and entries are
+-- identified by their period number instead. Existing entries are numbered in
+-- order as the length of their periods is unknown.
+CREATE TABLE history_new (
+	id            INTEGER PRIMARY KEY,
+	beer_id       INTEGER NOT NULL,
+	period        INTEGER NOT NULL,
+	timestamp     INTEGER NOT NULL,
+	sold_quantity INTEGER NOT NULL,
+	selling_price DECIMAL(6, 2) NOT NULL,
+
+	UNIQUE (beer_id, period),
+	FOREIGN KEY (beer_id) REFERENCES beers(id) ON DELETE CASCADE ON UPDATE CASCADE
+);
+
+INSERT INTO
+	history_new(id, beer_id, period, timestamp, sold_quantity, selling_price)
+SELECT
+	id,
+	beer_id,
+	ROW_NUMBER() OVER (PARTITION BY beer_id ORDER BY timestamp),
+	CAST(strftime('%s', timestamp) AS INTEGER) * 1000,
+	sold_quantity,
+	selling_price
+FROM
+	history;
+
+DROP TABLE history;
+
+ALTER TABLE history_new RENAME TO history;
+
+-- name: migrations/3
+CREATE TABLE orders (
+	id        INTEGER PRIMARY KEY,
+	user_id   INTEGER,
+	timestamp INTEGER NOT NULL,
+
+	FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE SET NULL ON UPDATE CASCADE
+);
+
+CREATE TABLE order_lines (
+	order_id INTEGER NOT NULL,
+	beer_id  INTEGER NOT NULL,
+	quantity INTEGER NOT NULL,
+
+	FOREIGN KEY (order_id) REFERENCES orders(id) ON DELETE CASCADE ON UPDATE CASCADE,
+	FOREIGN KEY (beer_id) REFERENCES beers(id) ON DELETE CASCADE ON UPDATE CASCADE
+);
+
+-- name: migrations/4
+CREATE TABLE events (
+	id        INTEGER PRIMARY KEY AUTOINCREMENT,
+	channel   TEXT NOT NULL,
+	data      TEXT NOT NULL,
+	timestamp INTEGER NOT NULL
+);
+
+CREATE TABLE leases (
+	name    TEXT PRIMARY KEY,
+	holder  TEXT NOT NULL,
+	expires INTEGER NOT NULL
+);
+
+-- name: migrations/5
+-- Tokens get an ID, so that they can be listed and revoked without revealing
+-- them, along with their creation, last use and expiry times (in Unix
+-- milliseconds). Existing tokens expire 30 days from now.
+CREATE TABLE tokens_new (
+	id        INTEGER PRIMARY KEY,
+	value     VARCHAR(256) UNIQUE NOT NULL,
+	user_id   INTEGER NOT NULL,
+	label     VARCHAR(256) NOT NULL DEFAULT '',
+	created   INTEGER NOT NULL,
+	last_used INTEGER NOT NULL,
+	expires   INTEGER NOT NULL,
+
+	FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE ON UPDATE CASCADE
+);
+
+INSERT INTO
+	tokens_new(value, user_id, created, last_used, expires)
+SELECT
+	value,
+	user_id,
+	CAST(strftime('%s', 'now') AS INTEGER) * 1000,
+	CAST(strftime('%s', 'now') AS INTEGER) * 1000,
+	(CAST(strftime('%s', 'now') AS INTEGER) + 30 * 24 * 3600) * 1000
+FROM
+	tokens;
+
+DROP TABLE tokens;
+
+ALTER TABLE tokens_new RENAME TO tokens;
+
+-- name: migrations/6
+-- Tokens are stored as SHA-256 hashes. Since plaintext tokens cannot be hashed
+-- in SQL, they are all deleted: users have to log in again.
+DELETE FROM tokens;
+
+ALTER TABLE tokens RENAME COLUMN value TO hash;
+
+-- name: migrations/7
+-- The admin flag is replaced by a role. Regular users become bartenders, who
+-- can do what they could.
+ALTER TABLE users ADD COLUMN role VARCHAR(32) NOT NULL DEFAULT 'bartender';
+
+UPDATE users SET role = 'admin' WHERE admin;
+
+ALTER TABLE users DROP COLUMN admin;
+
+-- name: migrations/8
+-- Users can be assigned to bars, in which case they can only order beers from
+-- these bars.
+CREATE TABLE user_bars (
+	user_id INTEGER NOT NULL,
+	bar_id  INTEGER NOT NULL,
+
+	PRIMARY KEY (user_id, bar_id),
+	FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE ON UPDATE CASCADE
+);
+
+-- name: migrations/9
+-- Audit entries are never updated nor deleted. Actors are not foreign keys so
+-- that entries outlive users.
+CREATE TABLE audit (
+	id        INTEGER PRIMARY KEY AUTOINCREMENT,
+	timestamp INTEGER NOT NULL,
+	actor_id  INTEGER,
+	action    VARCHAR(64) NOT NULL,
+	target    VARCHAR(256) NOT NULL DEFAULT '',
+	summary   TEXT NOT NULL DEFAULT '',
+	ip        VARCHAR(64) NOT NULL DEFAULT ''
+);
+
+-- name: migrations/10
+-- Users can be required to change their password before doing anything else,
+-- e.g. the default admin.
+ALTER TABLE users ADD COLUMN must_change_password BOOLEAN NOT NULL DEFAULT FALSE;
+
+-- name: migrations/11
+-- Terminals are shared devices registered by an admin, identified by the
+-- SHA-256 hash of a secret. Users can log in on them with a PIN (hashed like
+-- passwords) or a badge (see hashBadge), which gives tokens bound to the
+-- terminal.
+CREATE TABLE terminals (
+	id      INTEGER PRIMARY KEY,
+	name    VARCHAR(256) NOT NULL,
+	hash    VARCHAR(64) UNIQUE NOT NULL,
+	created INTEGER NOT NULL
+);
+
+ALTER TABLE users ADD COLUMN pin VARCHAR(256);
+
+ALTER TABLE users ADD COLUMN badge VARCHAR(64);
+
+CREATE UNIQUE INDEX users_badge_index ON users(badge);
+
+ALTER TABLE tokens ADD COLUMN terminal_id INTEGER REFERENCES terminals(id) ON DELETE CASCADE ON UPDATE CASCADE;
+
+-- name: migrations/12
+-- API keys let machine clients, such as displays, use some routes without a
+-- user account. Scopes are separated by commas, and keys without bars can
+-- order from all of them.
+CREATE TABLE api_keys (
+	id      INTEGER PRIMARY KEY,
+	name    VARCHAR(256) NOT NULL,
+	hash    VARCHAR(64) UNIQUE NOT NULL,
+	scopes  VARCHAR(256) NOT NULL,
+	created INTEGER NOT NULL,
+	expires INTEGER
+);
+
+CREATE TABLE api_key_bars (
+	api_key_id INTEGER NOT NULL,
+	bar_id     INTEGER NOT NULL,
+
+	PRIMARY KEY (api_key_id, bar_id),
+	FOREIGN KEY (api_key_id) REFERENCES api_keys(id) ON DELETE CASCADE ON UPDATE CASCADE
+);
@@ -0,0 +1,31 @@
+-- name: terminals/get-all
+SELECT
+	id,
+	name,
+	created
+FROM
+	terminals
+ORDER BY
+	id
+
+-- name: terminals/get-by-secret
+SELECT
+	id,
+	name,
+	created
+FROM
+	terminals
+WHERE
+	hash = ?1
+
+-- name: terminals/create
+INSERT INTO
+	terminals(name, hash, created)
+VALUES
+	(?1, ?2, ?3)
+
+-- name: terminals/delete
+DELETE FROM
+	terminals
+WHERE
+	id = ?1
@@ -7,26 +7,33 @@ VALUES
 
 -- name: testing/insert-history
 INSERT INTO
-	history(beer_id, timestamp, sold_quantity, selling_price)
+	history(beer_id, period, timestamp, sold_quantity, selling_price)
 VALUES
-	(1, 100, 10, 1.2),
-	(1, 200, 23, 1.4),
-	(1, 300, 5, 1.2),
-	(2, 100, 3, 5),
-	(2, 200, 9, 1),
-	(2, 300, 10, 1.2);
+	(1, 1, 900000, 10, 1.2),
+	(1, 2, 1800000, 23, 1.4),
+	(1, 3, 2700000, 5, 1.2),
+	(2, 1, 900000, 3, 5),
+	(2, 2, 1800000, 9, 1),
+	(2, 3, 2700000, 10, 1.2);
 
 -- name: testing/insert-users
 INSERT INTO
-	users(id, name, password, admin)
+	users(id, name, password, role)
 VALUES
-	(1, "admin", "hashedpwd", true),
-	(2, "bob", "hashedhash", false);
+	(1, "admin", "hashedpwd", "admin"),
+	(2, "bob", "hashedhash", "bartender");
+
+INSERT INTO
+	user_bars(user_id, bar_id)
+VALUES
+	(2, 3),
+	(2, 1);
 
 -- name: testing/insert-tokens
+-- Tokens are "incredibletoken" (expired), "amazingtoken" and "cooltoken".
 INSERT INTO
-	tokens(value, user_id)
+	tokens(id, hash, user_id, label, created, last_used, expires)
 VALUES
-	("incredibletoken", 1),
-	("amazingtoken", 1),
-	("cooltoken", 2);
+	(1, "1017bdb91548cda34955aa975708d49dbe99fea74ed776bb3acce6f96b4939d9", 1, "", 0, 0, 1000),
+	(2, "f61d58694a30c73376c03ff9b1530093be022448a9c42b5ec118d534f359aae4", 1, "phone", 0, 0, 9999999999999),
+	(3, "bb5e4c854266422f910d66c6757d156ce437f20b015b3f244e9bb13a6c2f8801", 2, "", 0, 0, 9999999999999);
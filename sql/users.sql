@@ -3,7 +3,11 @@ SELECT
 	id,
 	name,
 	password,
-	admin
+	role,
+	must_change_password,
+	COALESCE(pin, ''),
+	COALESCE(badge, ''),
+	(SELECT GROUP_CONCAT(bar_id) FROM (SELECT bar_id FROM user_bars WHERE user_id = users.id ORDER BY bar_id))
 FROM
 	users
 
@@ -13,12 +17,24 @@ SELECT
 FROM
 	users
 
+-- name: users/count-admins
+SELECT
+	COUNT(*)
+FROM
+	users
+WHERE
+	role = 'admin'
+
 -- name: users/get-by-id
 SELECT
 	id,
 	name,
 	password,
-	admin
+	role,
+	must_change_password,
+	COALESCE(pin, ''),
+	COALESCE(badge, ''),
+	(SELECT GROUP_CONCAT(bar_id) FROM (SELECT bar_id FROM user_bars WHERE user_id = users.id ORDER BY bar_id))
 FROM
 	users
 WHERE
@@ -29,7 +45,11 @@ SELECT
 	id,
 	name,
 	password,
-	admin
+	role,
+	must_change_password,
+	COALESCE(pin, ''),
+	COALESCE(badge, ''),
+	(SELECT GROUP_CONCAT(bar_id) FROM (SELECT bar_id FROM user_bars WHERE user_id = users.id ORDER BY bar_id))
 FROM
 	users
 WHERE
@@ -40,19 +60,51 @@ SELECT
 	u.id,
 	u.name,
 	u.password,
-	u.admin
+	u.role,
+	u.must_change_password,
+	COALESCE(u.pin, ''),
+	COALESCE(u.badge, ''),
+	(SELECT GROUP_CONCAT(bar_id) FROM (SELECT bar_id FROM user_bars WHERE user_id = u.id ORDER BY bar_id))
 FROM
 	tokens AS t
 INNER JOIN
 	users AS u ON u.id = t.user_id
 WHERE
-	t.value = ?1
+	t.hash = ?1
+	AND t.expires > ?2
+	AND (t.terminal_id IS NULL OR t.terminal_id = (SELECT id FROM terminals WHERE hash = ?3))
+
+-- name: users/get-by-badge
+SELECT
+	id,
+	name,
+	password,
+	role,
+	must_change_password,
+	COALESCE(pin, ''),
+	COALESCE(badge, ''),
+	(SELECT GROUP_CONCAT(bar_id) FROM (SELECT bar_id FROM user_bars WHERE user_id = users.id ORDER BY bar_id))
+FROM
+	users
+WHERE
+	badge = ?1
+
+-- name: users/touch-token
+-- Tokens' last use is only updated once a minute, to avoid writing on every
+-- request.
+UPDATE
+	tokens
+SET
+	last_used = ?2
+WHERE
+	hash = ?1
+	AND last_used < ?2 - 60000
 
 -- name: users/create
 INSERT INTO
-	users(name, password, admin)
+	users(name, password, role, must_change_password, pin, badge)
 VALUES
-	(?1, ?2, ?3)
+	(?1, ?2, ?3, ?4, NULLIF(?5, ''), NULLIF(?6, ''))
 
 -- name: users/update
 UPDATE
@@ -60,24 +112,76 @@ UPDATE
 SET
 	name = ?2,
 	password = ?3,
-	admin = ?4
+	role = ?4,
+	must_change_password = ?5,
+	pin = NULLIF(?6, ''),
+	badge = NULLIF(?7, '')
 WHERE
 	id = ?1
 
+-- name: users/delete-bars
+DELETE FROM
+	user_bars
+WHERE
+	user_id = ?1
+
+-- name: users/add-bar
+INSERT INTO
+	user_bars(user_id, bar_id)
+VALUES
+	(?1, ?2)
+ON CONFLICT DO NOTHING
+
 -- name: users/delete
 DELETE FROM
 	users
 WHERE
 	id = ?1
 
+-- name: users/get-tokens
+SELECT
+	id,
+	user_id,
+	label,
+	created,
+	last_used,
+	expires,
+	COALESCE(terminal_id, 0)
+FROM
+	tokens
+WHERE
+	user_id = ?1
+	AND expires > ?2
+ORDER BY
+	id
+
 -- name: users/create-token
 INSERT INTO
-	tokens(value, user_id)
+	tokens(hash, user_id, label, created, last_used, expires, terminal_id)
 VALUES
-	(?2, ?1)
+	(?2, ?1, ?3, ?4, ?4, ?5, NULLIF(?6, 0))
 
 -- name: users/delete-token
 DELETE FROM
 	tokens
 WHERE
-	value = ?1
+	hash = ?1
+
+-- name: users/delete-token-by-id
+DELETE FROM
+	tokens
+WHERE
+	id = ?2
+	AND user_id = ?1
+
+-- name: users/delete-tokens
+DELETE FROM
+	tokens
+WHERE
+	user_id = ?1
+
+-- name: users/delete-expired-tokens
+DELETE FROM
+	tokens
+WHERE
+	expires <= ?1
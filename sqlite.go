@@ -1,12 +1,19 @@
 package main
 
 import (
+	"crypto/hmac"
 	"crypto/rand"
+	"crypto/sha256"
 	"database/sql"
 	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
 	"os"
 	"path"
+	"strconv"
 	"strings"
+	"time"
 
 	_ "github.com/mattn/go-sqlite3"
 	"github.com/qustavo/dotsql"
@@ -15,7 +22,7 @@ import (
 func NewSqliteDatabase(dataSourceName string) (Database, error) {
 	var database Database
 
-	db, err := sql.Open("sqlite3", dataSourceName+"?_foreign_keys=on")
+	db, err := sql.Open("sqlite3", dataSourceName+"?_foreign_keys=on&_busy_timeout=5000")
 	if err != nil {
 		return database, err
 	}
@@ -29,8 +36,17 @@ func NewSqliteDatabase(dataSourceName string) (Database, error) {
 		return database, err
 	}
 
+	if err := migrate(db, dot); err != nil {
+		return database, err
+	}
+
 	database.Beers = &sqliteBeerManager{db, dot}
 	database.Users = &sqliteUserManager{db, dot}
+	database.Events = &sqliteEventManager{db, dot}
+	database.Audit = &sqliteAuditManager{db, dot}
+	database.Terminals = &sqliteTerminalManager{db, dot}
+	database.APIKeys = &sqliteAPIKeyManager{db, dot}
+	database.close = db.Close
 	return database, err
 }
 
@@ -55,6 +71,43 @@ func loadDotSqlFromDir(name string) (*dotsql.DotSql, error) {
 	return dotsql.Merge(dots...), nil
 }
 
+// migrate applies, in order, every "migrations/N" query that has not been
+// applied yet. The number of the last applied migration is stored in SQLite's
+// user_version.
+func migrate(db *sql.DB, dot *dotsql.DotSql) error {
+	var version int
+	if err := db.QueryRow("PRAGMA user_version").Scan(&version); err != nil {
+		return err
+	}
+
+	for {
+		name := fmt.Sprintf("migrations/%d", version+1)
+		if _, err := dot.Raw(name); err != nil {
+			return nil // no more migrations
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+
+		if _, err := dot.Exec(tx, name); err != nil {
+			tx.Rollback()
+			return err
+		}
+
+		version++
+		if _, err := tx.Exec(fmt.Sprintf("PRAGMA user_version = %d", version)); err != nil {
+			tx.Rollback()
+			return err
+		}
+
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+	}
+}
+
 type sqliteBeerManager struct {
 	db  *sql.DB
 	dot *dotsql.DotSql
@@ -70,7 +123,7 @@ func (m sqliteBeerManager) All() ([]Beer, error) {
 	beers := []Beer{}
 	for rows.Next() {
 		var b Beer
-		if err := rows.Scan(&b.ID, &b.BarID, &b.Name, &b.StockQuantity, &b.SoldQuantity, &b.PreviousSoldQuantity, &b.TotalSoldQuantity, &b.SellingPrice, &b.PreviousSellingPrice, &b.PurchasePrice, &b.BottleSize, &b.AlcoholContent, &b.IncrCoef, &b.DecrCoef, &b.MinCoef, &b.MaxCoef); err != nil {
+		if err := rows.Scan(&b.ID, &b.BarID, &b.Name, &b.StockQuantity, &b.SoldQuantity, &b.PreviousSoldQuantity, &b.TotalSoldQuantity, &b.SellingPrice, &b.PreviousSellingPrice, &b.PurchasePrice, &b.BottleSize, &b.AlcoholContent, &b.IncrCoef, &b.DecrCoef, &b.MinCoef, &b.MaxCoef, &b.MaxIncrease, &b.MaxDecrease, &b.MaxIncreaseRate, &b.MaxDecreaseRate, &b.MaxRises); err != nil {
 			return nil, err
 		}
 
@@ -84,8 +137,8 @@ func (m sqliteBeerManager) All() ([]Beer, error) {
 	return beers, nil
 }
 
-func (m sqliteBeerManager) Create(b *Beer) error {
-	result, err := m.dot.Exec(m.db, "beers/create", b.BarID, b.Name, b.StockQuantity, b.PurchasePrice, b.BottleSize, b.AlcoholContent, b.IncrCoef, b.DecrCoef, b.MinCoef, b.MaxCoef)
+func (m sqliteBeerManager) Create(b *Beer, p Period) error {
+	result, err := m.dot.Exec(m.db, "beers/create", b.BarID, b.Name, b.StockQuantity, b.PurchasePrice, b.BottleSize, b.AlcoholContent, b.IncrCoef, b.DecrCoef, b.MinCoef, b.MaxCoef, b.MaxIncrease, b.MaxDecrease, b.MaxIncreaseRate, b.MaxDecreaseRate, b.MaxRises)
 	if err != nil {
 		return err
 	}
@@ -95,7 +148,7 @@ func (m sqliteBeerManager) Create(b *Beer) error {
 		return err
 	}
 
-	if _, err := m.dot.Exec(m.db, "beers/update-price", id, b.PurchasePrice); err != nil {
+	if _, err := m.dot.Exec(m.db, "beers/update-price", id, b.PurchasePrice, p.Number, p.Timestamp.UnixMilli()); err != nil {
 		return err
 	}
 
@@ -128,6 +181,48 @@ func (m sqliteBeerManager) EstimatedProfit() (float64, error) {
 	return profit, nil
 }
 
+func (m sqliteBeerManager) History() ([]Record, error) {
+	rows, err := m.dot.Query(m.db, "beers/get-history")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	records := []Record{}
+	for rows.Next() {
+		var r Record
+		if err := rows.Scan(&r.BeerID, &r.Period, &r.SoldQuantity, &r.SellingPrice); err != nil {
+			return nil, err
+		}
+
+		records = append(records, r)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return records, nil
+}
+
+func (m sqliteBeerManager) LastUpdate() (time.Time, error) {
+	row, err := m.dot.QueryRow(m.db, "beers/get-last-update")
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	var timestamp sql.NullInt64
+	if err := row.Scan(&timestamp); err != nil {
+		return time.Time{}, err
+	}
+
+	if !timestamp.Valid {
+		return time.Time{}, nil
+	}
+
+	return time.UnixMilli(timestamp.Int64), nil
+}
+
 func (m sqliteBeerManager) MakeOrder(id uint, amount int) error {
 	if _, err := m.dot.Exec(m.db, "beers/make-order", id, amount); err != nil {
 		return err
@@ -136,30 +231,87 @@ func (m sqliteBeerManager) MakeOrder(id uint, amount int) error {
 	return nil
 }
 
-func (m sqliteBeerManager) UpdatePrice(id uint, price float64) error {
-	if _, err := m.dot.Exec(m.db, "beers/update-price", id, price); err != nil {
+func (m sqliteBeerManager) CreateOrder(o *Order) error {
+	tx, err := m.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := m.dot.Exec(tx, "beers/create-order", o.UserID, o.Timestamp.UnixMilli())
+	if err != nil {
+		return err
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return err
+	}
+
+	for _, line := range o.Lines {
+		result, err := m.dot.Exec(tx, "beers/make-order", line.ID, line.OrderedQuantity)
+		if err != nil {
+			return err
+		}
+
+		// Invalid IDs are ignored.
+		if n, err := result.RowsAffected(); err != nil {
+			return err
+		} else if n == 0 {
+			continue
+		}
+
+		if _, err := m.dot.Exec(tx, "beers/create-order-line", id, line.ID, line.OrderedQuantity); err != nil {
+			return err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	o.ID = uint(id)
+	return nil
+}
+
+func (m sqliteBeerManager) UpdatePrice(id uint, price float64, p Period) error {
+	if _, err := m.dot.Exec(m.db, "beers/update-price", id, price, p.Number, p.Timestamp.UnixMilli()); err != nil {
 		return err
 	}
 
 	return nil
 }
 
-func (m sqliteBeerManager) UpdatePrices() error {
+func (m sqliteBeerManager) UpdatePrices(p Period) error {
 	beers, err := m.All()
 	if err != nil {
 		return err
 	}
 
+	history, err := m.History()
+	if err != nil {
+		return err
+	}
+
+	// Prices are updated all at once so that a failed update can be retried.
+	tx, err := m.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	rises := ConsecutiveRises(history)
 	for _, beer := range beers {
+		beer.ConsecutiveRises = rises[beer.ID]
 		if beer.SoldQuantity == 0 && beer.PreviousSoldQuantity == 0 && beer.SellingPrice == beer.PreviousSellingPrice {
 			continue
 		}
-		if err := m.UpdatePrice(beer.ID, beer.NewPrice()); err != nil {
+		if _, err := m.dot.Exec(tx, "beers/update-price", beer.ID, beer.NewPrice(), p.Number, p.Timestamp.UnixMilli()); err != nil {
 			return err
 		}
 	}
 
-	return nil
+	return tx.Commit()
 }
 
 type sqliteUserManager struct {
@@ -176,8 +328,8 @@ func (m sqliteUserManager) All() ([]User, error) {
 
 	users := []User{}
 	for rows.Next() {
-		var user User
-		if err := rows.Scan(&user.ID, &user.Name, &user.Password, &user.Admin); err != nil {
+		user, err := scanUser(rows)
+		if err != nil {
 			return nil, err
 		}
 
@@ -213,79 +365,234 @@ func (m sqliteUserManager) ByID(id uint) (User, error) {
 		return user, err
 	}
 
-	if err := row.Scan(&user.ID, &user.Name, &user.Password, &user.Admin); err != nil {
+	return scanUser(row)
+}
+
+func (m sqliteUserManager) ByName(name string) (User, error) {
+	var user User
+
+	row, err := m.dot.QueryRow(m.db, "users/get-by-name", name)
+	if err != nil {
 		return user, err
 	}
 
-	return user, nil
+	return scanUser(row)
 }
 
-func (m sqliteUserManager) ByName(name string) (User, error) {
+// ByToken returns the user a token belongs to. Tokens bound to a terminal are
+// only valid along with the terminal's secret.
+func (m sqliteUserManager) ByToken(token, terminal string) (User, error) {
 	var user User
+	now := time.Now().UnixMilli()
 
-	row, err := m.dot.QueryRow(m.db, "users/get-by-name", name)
+	row, err := m.dot.QueryRow(m.db, "users/get-by-token", hashToken(token), now, hashToken(terminal))
 	if err != nil {
 		return user, err
 	}
 
-	if err := row.Scan(&user.ID, &user.Name, &user.Password, &user.Admin); err != nil {
+	if user, err = scanUser(row); err != nil {
+		return user, err
+	}
+
+	if _, err := m.dot.Exec(m.db, "users/touch-token", hashToken(token), now); err != nil {
 		return user, err
 	}
 
 	return user, nil
 }
 
-func (m sqliteUserManager) ByToken(token string) (User, error) {
+// scanUser scans a user from a row of the "users/get-…" queries.
+func scanUser(row interface{ Scan(...interface{}) error }) (User, error) {
 	var user User
-
-	row, err := m.dot.QueryRow(m.db, "users/get-by-token", token)
-	if err != nil {
+	var pin string
+	var bars sql.NullString
+	if err := row.Scan(&user.ID, &user.Name, &user.Password, &user.Role, &user.MustChangePassword, &pin, &user.Badge, &bars); err != nil {
 		return user, err
 	}
 
-	if err := row.Scan(&user.ID, &user.Name, &user.Password, &user.Admin); err != nil {
-		return user, err
+	if pin != "" {
+		user.PIN = []byte(pin)
+	}
+
+	user.Bars = []uint{}
+	for _, bar := range strings.Split(bars.String, ",") {
+		if id, err := strconv.ParseUint(bar, 10, 0); err == nil {
+			user.Bars = append(user.Bars, uint(id))
+		}
 	}
 
 	return user, nil
 }
 
-func (m sqliteUserManager) Create(name, password string, admin bool) (User, error) {
-	user := User{Name: name, Admin: admin}
-	user.SetPassword(password)
-	result, err := m.dot.Exec(m.db, "users/create", user.Name, user.Password, user.Admin)
+// ByBadge returns the user a badge belongs to.
+func (m sqliteUserManager) ByBadge(badge string) (User, error) {
+	var user User
+
+	row, err := m.dot.QueryRow(m.db, "users/get-by-badge", hashBadge(badge))
 	if err != nil {
 		return user, err
 	}
 
+	return scanUser(row)
+}
+
+// Create stores a new user, along with its bars. Its password must already be
+// set (see User.SetPassword).
+func (m sqliteUserManager) Create(u *User) error {
+	tx, err := m.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := m.dot.Exec(tx, "users/create", u.Name, u.Password, u.Role, u.MustChangePassword, string(u.PIN), u.Badge)
+	if err != nil {
+		return err
+	}
+
 	id, err := result.LastInsertId()
 	if err != nil {
-		return user, err
+		return err
 	}
 
-	user.ID = uint(id)
-	return user, nil
-}
+	for _, bar := range u.Bars {
+		if _, err := m.dot.Exec(tx, "users/add-bar", id, bar); err != nil {
+			return err
+		}
+	}
 
-func (m sqliteUserManager) Update(u *User) error {
-	if _, err := m.dot.Exec(m.db, "users/update", u.ID, u.Name, u.Password, u.Admin); err != nil {
+	if err := tx.Commit(); err != nil {
 		return err
 	}
 
+	u.ID = uint(id)
+	if u.Bars == nil {
+		u.Bars = []uint{}
+	}
 	return nil
 }
 
-func (m sqliteUserManager) Delete(id uint) error {
-	if _, err := m.dot.Exec(m.db, "users/delete", id); err != nil {
+// Update updates a user, including its bars.
+func (m sqliteUserManager) Update(u *User) error {
+	tx, err := m.db.Begin()
+	if err != nil {
 		return err
 	}
+	defer tx.Rollback()
 
-	return nil
+	admins, err := m.countAdmins(tx)
+	if err != nil {
+		return err
+	}
+
+	if _, err := m.dot.Exec(tx, "users/update", u.ID, u.Name, u.Password, u.Role, u.MustChangePassword, string(u.PIN), u.Badge); err != nil {
+		return err
+	}
+
+	if _, err := m.dot.Exec(tx, "users/delete-bars", u.ID); err != nil {
+		return err
+	}
+
+	for _, bar := range u.Bars {
+		if _, err := m.dot.Exec(tx, "users/add-bar", u.ID, bar); err != nil {
+			return err
+		}
+	}
+
+	if remaining, err := m.countAdmins(tx); err != nil {
+		return err
+	} else if admins > 0 && remaining == 0 {
+		return errLastAdmin
+	}
+
+	return tx.Commit()
+}
+
+// Delete deletes a user. It returns false if there is no such user.
+func (m sqliteUserManager) Delete(id uint) (bool, error) {
+	tx, err := m.db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	admins, err := m.countAdmins(tx)
+	if err != nil {
+		return false, err
+	}
+
+	result, err := m.dot.Exec(tx, "users/delete", id)
+	if err != nil {
+		return false, err
+	}
+
+	n, err := result.RowsAffected()
+	if err != nil || n == 0 {
+		return false, err
+	}
+
+	if remaining, err := m.countAdmins(tx); err != nil {
+		return false, err
+	} else if admins > 0 && remaining == 0 {
+		return false, errLastAdmin
+	}
+
+	return true, tx.Commit()
+}
+
+// countAdmins counts admins within a transaction. Counting them before and
+// after a change tells if it removed the last one: SQLite fails the
+// transaction if another one changed users in between, so this is atomic.
+func (m sqliteUserManager) countAdmins(tx *sql.Tx) (uint, error) {
+	row, err := m.dot.QueryRow(tx, "users/count-admins")
+	if err != nil {
+		return 0, err
+	}
+
+	var admins uint
+	err = row.Scan(&admins)
+	return admins, err
+}
+
+func (m sqliteUserManager) Tokens(userID uint) ([]Token, error) {
+	rows, err := m.dot.Query(m.db, "users/get-tokens", userID, time.Now().UnixMilli())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tokens := []Token{}
+	for rows.Next() {
+		var token Token
+		var created, lastUsed, expires int64
+		if err := rows.Scan(&token.ID, &token.UserID, &token.Label, &created, &lastUsed, &expires, &token.TerminalID); err != nil {
+			return nil, err
+		}
+
+		token.Created = time.UnixMilli(created)
+		token.LastUsed = time.UnixMilli(lastUsed)
+		token.Expires = time.UnixMilli(expires)
+		tokens = append(tokens, token)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return tokens, nil
 }
 
-func (m sqliteUserManager) CreateToken(userID uint) (string, error) {
+// CreateToken creates a token valid for the given duration, bound to a
+// terminal unless terminalID is 0. Expired tokens are deleted at the same
+// time.
+func (m sqliteUserManager) CreateToken(userID, terminalID uint, label string, ttl time.Duration) (string, error) {
+	now := time.Now()
 	token := generateToken()
-	if _, err := m.dot.Exec(m.db, "users/create-token", userID, token); err != nil {
+	if _, err := m.dot.Exec(m.db, "users/create-token", userID, hashToken(token), label, now.UnixMilli(), now.Add(ttl).UnixMilli(), terminalID); err != nil {
+		return token, err
+	}
+
+	if _, err := m.dot.Exec(m.db, "users/delete-expired-tokens", now.UnixMilli()); err != nil {
 		return token, err
 	}
 
@@ -303,10 +610,413 @@ func generateToken() string {
 	return base64.RawURLEncoding.EncodeToString(bytes)
 }
 
+// hashToken returns the SHA-256 hash of a token, which is what is stored in
+// the database. Tokens are random enough not to need a salt.
+func hashToken(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(hash[:])
+}
+
+// badgeSecret is the key of the badges' HMAC. It is set at startup from the
+// BADGE_SECRET variable.
+var badgeSecret []byte
+
+// hashBadge returns the HMAC-SHA256 of a badge's code, keyed by badgeSecret,
+// which is what is stored in the database.
+func hashBadge(code string) string {
+	mac := hmac.New(sha256.New, badgeSecret)
+	mac.Write([]byte(code))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
 func (m sqliteUserManager) DeleteToken(token string) error {
-	if _, err := m.dot.Exec(m.db, "users/delete-token", token); err != nil {
+	if _, err := m.dot.Exec(m.db, "users/delete-token", hashToken(token)); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (m sqliteUserManager) DeleteTokenByID(userID, tokenID uint) (bool, error) {
+	result, err := m.dot.Exec(m.db, "users/delete-token-by-id", userID, tokenID)
+	if err != nil {
+		return false, err
+	}
+
+	n, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return n == 1, nil
+}
+
+func (m sqliteUserManager) DeleteTokens(userID uint) error {
+	if _, err := m.dot.Exec(m.db, "users/delete-tokens", userID); err != nil {
 		return err
 	}
 
 	return nil
 }
+
+// eventRetention is the time relayed events are kept in the database. Other
+// instances should have read them by then.
+const eventRetention = time.Minute
+
+type sqliteEventManager struct {
+	db  *sql.DB
+	dot *dotsql.DotSql
+}
+
+func (m sqliteEventManager) Publish(channel string, e Event) error {
+	now := time.Now()
+	if _, err := m.dot.Exec(m.db, "events/publish", channel, marshal(e), now.UnixMilli()); err != nil {
+		return err
+	}
+
+	if _, err := m.dot.Exec(m.db, "events/delete-old", now.Add(-eventRetention).UnixMilli()); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (m sqliteEventManager) Since(channel string, lastID uint64) ([]Event, error) {
+	rows, err := m.dot.Query(m.db, "events/get-since", channel, lastID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := []Event{}
+	for rows.Next() {
+		var id uint64
+		var data string
+		if err := rows.Scan(&id, &data); err != nil {
+			return nil, err
+		}
+
+		var e Event
+		if err := json.Unmarshal([]byte(data), &e); err != nil {
+			return nil, err
+		}
+
+		e.ID = id
+		events = append(events, e)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return events, nil
+}
+
+func (m sqliteEventManager) LastID() (uint64, error) {
+	row, err := m.dot.QueryRow(m.db, "events/get-last-id")
+	if err != nil {
+		return 0, err
+	}
+
+	var id uint64
+	if err := row.Scan(&id); err != nil {
+		return 0, err
+	}
+
+	return id, nil
+}
+
+func (m sqliteEventManager) AcquireLease(name, holder string, now time.Time, ttl time.Duration) (bool, error) {
+	result, err := m.dot.Exec(m.db, "leases/acquire", name, holder, now.UnixMilli(), now.Add(ttl).UnixMilli())
+	if err != nil {
+		return false, err
+	}
+
+	n, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return n == 1, nil
+}
+
+func (m sqliteEventManager) ReleaseLease(name, holder string) error {
+	if _, err := m.dot.Exec(m.db, "leases/release", name, holder); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+type sqliteAuditManager struct {
+	db  *sql.DB
+	dot *dotsql.DotSql
+}
+
+func (m sqliteAuditManager) Record(e *AuditEntry) error {
+	result, err := m.dot.Exec(m.db, "audit/record", e.Timestamp.UnixMilli(), e.ActorID, e.Action, e.Target, e.Summary, e.IP)
+	if err != nil {
+		return err
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return err
+	}
+
+	e.ID = uint(id)
+	return nil
+}
+
+// Find returns the entries matching a query, most recent first.
+func (m sqliteAuditManager) Find(q AuditQuery) ([]AuditEntry, error) {
+	var since, until int64
+	if !q.Since.IsZero() {
+		since = q.Since.UnixMilli()
+	}
+	if !q.Until.IsZero() {
+		until = q.Until.UnixMilli()
+	}
+
+	rows, err := m.dot.Query(m.db, "audit/get", q.ActorID, strings.Join(q.Actions, ","), q.Target, since, until, q.Before, q.Limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := []AuditEntry{}
+	for rows.Next() {
+		var e AuditEntry
+		var timestamp int64
+		if err := rows.Scan(&e.ID, &timestamp, &e.ActorID, &e.ActorName, &e.Action, &e.Target, &e.Summary, &e.IP); err != nil {
+			return nil, err
+		}
+
+		e.Timestamp = time.UnixMilli(timestamp)
+		entries = append(entries, e)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return entries, nil
+}
+
+type sqliteTerminalManager struct {
+	db  *sql.DB
+	dot *dotsql.DotSql
+}
+
+func (m sqliteTerminalManager) All() ([]Terminal, error) {
+	rows, err := m.dot.Query(m.db, "terminals/get-all")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	terminals := []Terminal{}
+	for rows.Next() {
+		var terminal Terminal
+		var created int64
+		if err := rows.Scan(&terminal.ID, &terminal.Name, &created); err != nil {
+			return nil, err
+		}
+
+		terminal.Created = time.UnixMilli(created)
+		terminals = append(terminals, terminal)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return terminals, nil
+}
+
+func (m sqliteTerminalManager) BySecret(secret string) (Terminal, error) {
+	var terminal Terminal
+
+	row, err := m.dot.QueryRow(m.db, "terminals/get-by-secret", hashToken(secret))
+	if err != nil {
+		return terminal, err
+	}
+
+	var created int64
+	if err := row.Scan(&terminal.ID, &terminal.Name, &created); err != nil {
+		return terminal, err
+	}
+
+	terminal.Created = time.UnixMilli(created)
+	return terminal, nil
+}
+
+// Create registers a terminal and returns it along with its secret, which is
+// only stored as a hash.
+func (m sqliteTerminalManager) Create(name string) (Terminal, string, error) {
+	terminal := Terminal{Name: name, Created: time.Now()}
+	secret := generateToken()
+
+	result, err := m.dot.Exec(m.db, "terminals/create", name, hashToken(secret), terminal.Created.UnixMilli())
+	if err != nil {
+		return terminal, secret, err
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return terminal, secret, err
+	}
+
+	terminal.ID = uint(id)
+	return terminal, secret, nil
+}
+
+// Delete unregisters a terminal, along with the tokens bound to it.
+func (m sqliteTerminalManager) Delete(id uint) (bool, error) {
+	result, err := m.dot.Exec(m.db, "terminals/delete", id)
+	if err != nil {
+		return false, err
+	}
+
+	n, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return n == 1, nil
+}
+
+type sqliteAPIKeyManager struct {
+	db  *sql.DB
+	dot *dotsql.DotSql
+}
+
+func (m sqliteAPIKeyManager) All() ([]APIKey, error) {
+	rows, err := m.dot.Query(m.db, "api-keys/get-all")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := []APIKey{}
+	for rows.Next() {
+		key, err := scanAPIKey(rows)
+		if err != nil {
+			return nil, err
+		}
+
+		keys = append(keys, key)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return keys, nil
+}
+
+// ByKey returns the API key with a given value, unless it expired.
+func (m sqliteAPIKeyManager) ByKey(key string) (APIKey, error) {
+	row, err := m.dot.QueryRow(m.db, "api-keys/get-by-key", hashToken(key), time.Now().UnixMilli())
+	if err != nil {
+		return APIKey{}, err
+	}
+
+	return scanAPIKey(row)
+}
+
+// scanAPIKey scans an API key from a row of the "api-keys/get-…" queries.
+func scanAPIKey(row interface{ Scan(...interface{}) error }) (APIKey, error) {
+	var key APIKey
+	var scopes string
+	var created, expires int64
+	var bars sql.NullString
+	if err := row.Scan(&key.ID, &key.Name, &scopes, &created, &expires, &bars); err != nil {
+		return key, err
+	}
+
+	key.Created = time.UnixMilli(created)
+	if expires != 0 {
+		t := time.UnixMilli(expires)
+		key.Expires = &t
+	}
+
+	key.Scopes = []Scope{}
+	for _, scope := range strings.Split(scopes, ",") {
+		if scope != "" {
+			key.Scopes = append(key.Scopes, Scope(scope))
+		}
+	}
+
+	key.Bars = []uint{}
+	for _, bar := range strings.Split(bars.String, ",") {
+		if id, err := strconv.ParseUint(bar, 10, 0); err == nil {
+			key.Bars = append(key.Bars, uint(id))
+		}
+	}
+
+	return key, nil
+}
+
+// Create stores a new API key, along with its bars, and returns its value,
+// which is only stored as a hash.
+func (m sqliteAPIKeyManager) Create(k *APIKey) (string, error) {
+	key := generateToken()
+	k.Created = time.Now()
+	if k.Scopes == nil {
+		k.Scopes = []Scope{}
+	}
+	if k.Bars == nil {
+		k.Bars = []uint{}
+	}
+
+	scopes := make([]string, len(k.Scopes))
+	for i, scope := range k.Scopes {
+		scopes[i] = string(scope)
+	}
+
+	var expires int64
+	if k.Expires != nil {
+		expires = k.Expires.UnixMilli()
+	}
+
+	tx, err := m.db.Begin()
+	if err != nil {
+		return key, err
+	}
+	defer tx.Rollback()
+
+	result, err := m.dot.Exec(tx, "api-keys/create", k.Name, hashToken(key), strings.Join(scopes, ","), k.Created.UnixMilli(), expires)
+	if err != nil {
+		return key, err
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return key, err
+	}
+
+	for _, bar := range k.Bars {
+		if _, err := m.dot.Exec(tx, "api-keys/add-bar", id, bar); err != nil {
+			return key, err
+		}
+	}
+
+	k.ID = uint(id)
+	return key, tx.Commit()
+}
+
+// Delete revokes an API key.
+func (m sqliteAPIKeyManager) Delete(id uint) (bool, error) {
+	result, err := m.dot.Exec(m.db, "api-keys/delete", id)
+	if err != nil {
+		return false, err
+	}
+
+	n, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return n == 1, nil
+}
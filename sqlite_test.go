@@ -2,8 +2,10 @@ package main
 
 import (
 	"database/sql"
+	"path"
 	"reflect"
 	"testing"
+	"time"
 )
 
 func newSqliteBeerManager() *sqliteBeerManager {
@@ -56,6 +58,15 @@ func (m sqliteUserManager) mustCount(table string) int {
 	return count
 }
 
+func TestMigrationsAreAppliedOnce(t *testing.T) {
+	name := path.Join(t.TempDir(), "db.sqlite3")
+	for i := 0; i < 2; i++ {
+		if _, err := NewSqliteDatabase(name); err != nil {
+			t.Fatalf("NewSqliteDatabase() #%v failed: %v", i+1, err)
+		}
+	}
+}
+
 func TestAllBeersWithoutHistory(t *testing.T) {
 	beers := newSqliteBeerManager()
 	beers.mustExec("testing/insert-beers")
@@ -166,7 +177,7 @@ func TestAllBeersWithHistory(t *testing.T) {
 func TestCreateBeer(t *testing.T) {
 	beers := newSqliteBeerManager()
 
-	if err := beers.Create(&Beer{}); err != nil {
+	if err := beers.Create(&Beer{}, Period{}); err != nil {
 		t.Errorf("beers.Create() failed: %v", err)
 	}
 
@@ -196,7 +207,7 @@ func TestCreateBeersUpdating(t *testing.T) {
 		MinCoef:        0.9,
 		MaxCoef:        2.5,
 	}
-	if err := beers.Create(&got); err != nil {
+	if err := beers.Create(&got, Period{}); err != nil {
 		t.Errorf("beers.Create() failed: %v", err)
 	}
 
@@ -256,6 +267,106 @@ func TestEstimatedProfit(t *testing.T) {
 	}
 }
 
+func TestBeerHistory(t *testing.T) {
+	beers := newSqliteBeerManager()
+	beers.mustExec("testing/insert-beers")
+	beers.mustExec("testing/insert-history")
+
+	got, err := beers.History()
+	if err != nil {
+		t.Errorf("beers.History() failed: %v", err)
+	}
+
+	want := []Record{
+		{BeerID: 1, Period: 1, SoldQuantity: 10, SellingPrice: 1.2},
+		{BeerID: 1, Period: 2, SoldQuantity: 23, SellingPrice: 1.4},
+		{BeerID: 1, Period: 3, SoldQuantity: 5, SellingPrice: 1.2},
+		{BeerID: 2, Period: 1, SoldQuantity: 3, SellingPrice: 5},
+		{BeerID: 2, Period: 2, SoldQuantity: 9, SellingPrice: 1},
+		{BeerID: 2, Period: 3, SoldQuantity: 10, SellingPrice: 1.2},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("beers.History() = %v; got %v", want, got)
+	}
+}
+
+func TestCreateOrder(t *testing.T) {
+	beers := newSqliteBeerManager()
+	beers.mustExec("testing/insert-beers")
+	beers.mustExec("testing/insert-history")
+	beers.mustExec("testing/insert-users")
+
+	order := Order{
+		UserID:    1,
+		Timestamp: time.UnixMilli(3600000),
+		Lines:     []OrderLine{{ID: 1, OrderedQuantity: 2}, {ID: 3, OrderedQuantity: 1}, {ID: 2, OrderedQuantity: -1}},
+	}
+	if err := beers.CreateOrder(&order); err != nil {
+		t.Fatalf("beers.CreateOrder() failed: %v", err)
+	}
+
+	if order.ID != 1 {
+		t.Errorf("order.ID = 1; got %v", order.ID)
+	}
+
+	// The line about an unknown beer is ignored.
+	if count := beers.mustCount("order_lines"); count != 2 {
+		t.Errorf("linesCount = 2; got %v", count)
+	}
+
+	history, err := beers.History()
+	if err != nil {
+		t.Fatalf("beers.History() failed: %v", err)
+	}
+	if history[2].SoldQuantity != 7 || history[5].SoldQuantity != 9 {
+		t.Errorf("sold quantities = 7, 9; got %v, %v", history[2].SoldQuantity, history[5].SoldQuantity)
+	}
+}
+
+func TestLastUpdate(t *testing.T) {
+	beers := newSqliteBeerManager()
+
+	got, err := beers.LastUpdate()
+	if err != nil {
+		t.Errorf("beers.LastUpdate() failed: %v", err)
+	}
+	if !got.IsZero() {
+		t.Errorf("beers.LastUpdate() = zero time; got %v", got)
+	}
+
+	beers.mustExec("testing/insert-beers")
+	beers.mustExec("testing/insert-history")
+
+	got, err = beers.LastUpdate()
+	if err != nil {
+		t.Errorf("beers.LastUpdate() failed: %v", err)
+	}
+	if want := time.UnixMilli(2700000); !got.Equal(want) {
+		t.Errorf("beers.LastUpdate() = %v; got %v", want, got)
+	}
+}
+
+func TestUpdatePricesWithinTheSameSecond(t *testing.T) {
+	beers := newSqliteBeerManager()
+	now := time.UnixMilli(1000)
+
+	beer := Beer{PurchasePrice: 1, IncrCoef: 0.1, MinCoef: 0.5, MaxCoef: 2}
+	if err := beers.Create(&beer, Period{Number: 1, Timestamp: now}); err != nil {
+		t.Errorf("beers.Create() failed: %v", err)
+	}
+	if err := beers.MakeOrder(beer.ID, 2); err != nil {
+		t.Errorf("beers.MakeOrder() failed: %v", err)
+	}
+	if err := beers.UpdatePrices(Period{Number: 2, Timestamp: now}); err != nil {
+		t.Errorf("beers.UpdatePrices() failed: %v", err)
+	}
+
+	historyCount := beers.mustCount("history")
+	if historyCount != 2 {
+		t.Errorf("historyCount = 2; got %v", historyCount)
+	}
+}
+
 func TestAllUsers(t *testing.T) {
 	users := newSqliteUserManager()
 	users.mustExec("testing/insert-users")
@@ -266,8 +377,8 @@ func TestAllUsers(t *testing.T) {
 	}
 
 	want := []User{
-		{ID: 1, Name: "admin", Password: []byte("hashedpwd"), Admin: true},
-		{ID: 2, Name: "bob", Password: []byte("hashedhash"), Admin: false},
+		{ID: 1, Name: "admin", Password: []byte("hashedpwd"), Role: RoleAdmin, Bars: []uint{}},
+		{ID: 2, Name: "bob", Password: []byte("hashedhash"), Role: RoleBartender, Bars: []uint{1, 3}},
 	}
 	if !reflect.DeepEqual(got, want) {
 		t.Errorf("users.All() = %v; got %v", want, got)
@@ -310,7 +421,7 @@ func TestUserByID(t *testing.T) {
 		t.Errorf("users.ByID(2) failed: %v", err)
 	}
 
-	want := User{ID: 2, Name: "bob", Password: []byte("hashedhash"), Admin: false}
+	want := User{ID: 2, Name: "bob", Password: []byte("hashedhash"), Role: RoleBartender, Bars: []uint{1, 3}}
 	if !reflect.DeepEqual(got, want) {
 		t.Errorf("users.ByID(2) = %v; got %v", want, got)
 	}
@@ -325,7 +436,7 @@ func TestUserByName(t *testing.T) {
 		t.Errorf("users.ByName(\"admin\") failed: %v", err)
 	}
 
-	want := User{ID: 1, Name: "admin", Password: []byte("hashedpwd"), Admin: true}
+	want := User{ID: 1, Name: "admin", Password: []byte("hashedpwd"), Role: RoleAdmin, Bars: []uint{}}
 	if !reflect.DeepEqual(got, want) {
 		t.Errorf("users.ByName(\"admin\") = %v: got %v", want, got)
 	}
@@ -336,12 +447,12 @@ func TestUserByToken(t *testing.T) {
 	users.mustExec("testing/insert-users")
 	users.mustExec("testing/insert-tokens")
 
-	got, err := users.ByToken("amazingtoken")
+	got, err := users.ByToken("amazingtoken", "")
 	if err != nil {
 		t.Errorf("users.ByToken() failed: %v", err)
 	}
 
-	want := User{ID: 1, Name: "admin", Password: []byte("hashedpwd"), Admin: true}
+	want := User{ID: 1, Name: "admin", Password: []byte("hashedpwd"), Role: RoleAdmin, Bars: []uint{}}
 	if !reflect.DeepEqual(got, want) {
 		t.Errorf("users.ByToken() = %v: got %v", want, got)
 	}
@@ -352,7 +463,7 @@ func TestUserByTokenWithBadToken(t *testing.T) {
 	users.mustExec("testing/insert-users")
 	users.mustExec("testing/insert-tokens")
 
-	if _, err := users.ByToken("amazedtoken"); err == nil {
+	if _, err := users.ByToken("amazedtoken", ""); err == nil {
 		t.Errorf("users.ByToken() succeeded but shouldn't")
 	}
 }
@@ -361,26 +472,162 @@ func TestUserByTokenWithoutTokens(t *testing.T) {
 	users := newSqliteUserManager()
 	users.mustExec("testing/insert-users")
 
-	if _, err := users.ByToken("amazingtoken"); err == nil {
+	if _, err := users.ByToken("amazingtoken", ""); err == nil {
 		t.Errorf("users.ByToken() succeeded but shouldn't")
 	}
 }
 
-func TestCreateUser(t *testing.T) {
+func TestUserByTokenWithHash(t *testing.T) {
+	users := newSqliteUserManager()
+	users.mustExec("testing/insert-users")
+	users.mustExec("testing/insert-tokens")
+
+	if _, err := users.ByToken(hashToken("amazingtoken"), ""); err == nil {
+		t.Errorf("users.ByToken() succeeded but shouldn't")
+	}
+}
+
+func TestUserByTokenWithExpiredToken(t *testing.T) {
+	users := newSqliteUserManager()
+	users.mustExec("testing/insert-users")
+	users.mustExec("testing/insert-tokens")
+
+	if _, err := users.ByToken("incredibletoken", ""); err == nil {
+		t.Errorf("users.ByToken() succeeded but shouldn't")
+	}
+}
+
+func TestUserTokens(t *testing.T) {
 	users := newSqliteUserManager()
+	users.mustExec("testing/insert-users")
+	users.mustExec("testing/insert-tokens")
 
-	got, err := users.Create("alice", "secret", true)
+	got, err := users.Tokens(1)
 	if err != nil {
+		t.Errorf("users.Tokens() failed: %v", err)
+	}
+
+	want := []Token{{ID: 2, UserID: 1, Label: "phone", Created: time.UnixMilli(0), LastUsed: time.UnixMilli(0), Expires: time.UnixMilli(9999999999999)}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("users.Tokens() = %v; got %v", want, got)
+	}
+}
+
+func TestCreateToken(t *testing.T) {
+	users := newSqliteUserManager()
+	users.mustExec("testing/insert-users")
+	users.mustExec("testing/insert-tokens")
+
+	token, err := users.CreateToken(2, 0, "till", time.Hour)
+	if err != nil {
+		t.Errorf("users.CreateToken() failed: %v", err)
+	}
+
+	if user, err := users.ByToken(token, ""); err != nil || user.ID != 2 {
+		t.Errorf("users.ByToken() = 2; got %v (%v)", user.ID, err)
+	}
+
+	var hash string
+	if err := users.db.QueryRow("SELECT hash FROM tokens WHERE user_id = 2 AND label = 'till'").Scan(&hash); err != nil {
+		t.Errorf("cannot get token hash: %v", err)
+	}
+	if hash != hashToken(token) {
+		t.Errorf("token hash = %v; got %v", hashToken(token), hash)
+	}
+
+	// The expired token is deleted.
+	tokensCount := users.mustCount("tokens")
+	if tokensCount != 3 {
+		t.Errorf("tokensCount = 3; got %v", tokensCount)
+	}
+}
+
+func TestDeleteTokenByID(t *testing.T) {
+	users := newSqliteUserManager()
+	users.mustExec("testing/insert-users")
+	users.mustExec("testing/insert-tokens")
+
+	tests := []struct {
+		userID, tokenID uint
+		want            bool
+	}{
+		{1, 3, false}, // someone else's token
+		{1, 2, true},
+		{1, 2, false},
+	}
+
+	for _, test := range tests {
+		got, err := users.DeleteTokenByID(test.userID, test.tokenID)
+		if err != nil {
+			t.Errorf("users.DeleteTokenByID() failed: %v", err)
+		}
+		if got != test.want {
+			t.Errorf("users.DeleteTokenByID(%v, %v) = %v; got %v", test.userID, test.tokenID, test.want, got)
+		}
+	}
+}
+
+func TestDeleteTokens(t *testing.T) {
+	users := newSqliteUserManager()
+	users.mustExec("testing/insert-users")
+	users.mustExec("testing/insert-tokens")
+
+	if err := users.DeleteTokens(1); err != nil {
+		t.Errorf("users.DeleteTokens() failed: %v", err)
+	}
+
+	tokensCount := users.mustCount("tokens")
+	if tokensCount != 1 {
+		t.Errorf("tokensCount = 1; got %v", tokensCount)
+	}
+}
+
+func TestCreateUser(t *testing.T) {
+	users := newSqliteUserManager()
+
+	got := User{Name: "alice", Role: RoleAdmin}
+	got.SetPassword("secret")
+	if err := users.Create(&got); err != nil {
 		t.Errorf("users.Create() failed: %v", err)
 	}
 
-	want := User{ID: 1, Name: "alice", Password: got.Password, Admin: true}
+	want := User{ID: 1, Name: "alice", Password: got.Password, Role: RoleAdmin, Bars: []uint{}}
 	if !reflect.DeepEqual(got, want) {
 		t.Errorf("users.Create() = %v; got %v", want, got)
 	}
 	if !got.CheckPassword("secret") {
 		t.Errorf("user.CheckPassword() failed but shouldn't")
 	}
+
+	// Bars, PIN and badge are stored along with the user.
+	bob := User{Name: "bob", Role: RoleBartender, Bars: []uint{1, 2}}
+	bob.SetPassword("secret")
+	bob.SetPIN("1234")
+	bob.SetBadge("04A224B2C35E80")
+	if err := users.Create(&bob); err != nil {
+		t.Errorf("users.Create() failed: %v", err)
+	}
+	if stored, err := users.ByBadge("04A224B2C35E80"); err != nil || !reflect.DeepEqual(stored, bob) {
+		t.Errorf("users.ByBadge() = %v; got %v (%v)", bob, stored, err)
+	}
+}
+
+func TestUpdateUserBars(t *testing.T) {
+	users := newSqliteUserManager()
+	users.mustExec("testing/insert-users")
+
+	user := User{ID: 2, Name: "bobby", Password: []byte("hashedhash"), Role: RoleCashier, Bars: []uint{2}}
+	if err := users.Update(&user); err != nil {
+		t.Errorf("users.Update() failed: %v", err)
+	}
+
+	got, err := users.ByID(2)
+	if err != nil {
+		t.Errorf("users.ByID(2) failed: %v", err)
+	}
+	if !reflect.DeepEqual(got, user) {
+		t.Errorf("users.ByID(2) = %v; got %v", user, got)
+	}
 }
 
 func TestDeleteUser(t *testing.T) {
@@ -388,8 +635,11 @@ func TestDeleteUser(t *testing.T) {
 	users.mustExec("testing/insert-users")
 	users.mustExec("testing/insert-tokens")
 
-	if err := users.Delete(1); err != nil {
-		t.Errorf("users.Delete() failed: %v", err)
+	if found, err := users.Delete(2); err != nil || !found {
+		t.Errorf("users.Delete(2) = true; got %v (%v)", found, err)
+	}
+	if found, err := users.Delete(3); err != nil || found {
+		t.Errorf("users.Delete(3) = false; got %v (%v)", found, err)
 	}
 
 	usersCount := users.mustCount("users")
@@ -398,7 +648,329 @@ func TestDeleteUser(t *testing.T) {
 	}
 
 	tokensCount := users.mustCount("tokens")
-	if tokensCount != 1 {
-		t.Errorf("tokensCount = 1; got %v", tokensCount)
+	if tokensCount != 2 {
+		t.Errorf("tokensCount = 2; got %v", tokensCount)
+	}
+}
+
+func TestLastAdmin(t *testing.T) {
+	users := newSqliteUserManager()
+	users.mustExec("testing/insert-users")
+
+	if found, err := users.Delete(1); err != errLastAdmin || found {
+		t.Errorf("users.Delete(1) = %v; got %v (%v)", errLastAdmin, found, err)
+	}
+
+	admin, err := users.ByID(1)
+	if err != nil {
+		t.Fatalf("users.ByID(1) failed: %v", err)
+	}
+	admin.Role = RoleCashier
+	if err := users.Update(&admin); err != errLastAdmin {
+		t.Errorf("users.Update() = %v; got %v", errLastAdmin, err)
+	}
+
+	bob, err := users.ByID(2)
+	if err != nil {
+		t.Fatalf("users.ByID(2) failed: %v", err)
+	}
+	bob.Role = RoleAdmin
+	if err := users.Update(&bob); err != nil {
+		t.Errorf("users.Update() failed: %v", err)
+	}
+	if err := users.Update(&admin); err != nil {
+		t.Errorf("users.Update() failed once another admin exists: %v", err)
+	}
+	if found, err := users.Delete(2); err != errLastAdmin || found {
+		t.Errorf("users.Delete(2) = %v; got %v (%v)", errLastAdmin, found, err)
+	}
+}
+
+func newSqliteEventManager() *sqliteEventManager {
+	db, err := NewSqliteDatabase(":memory:")
+	if err != nil {
+		panic(err)
+	}
+	return db.Events.(*sqliteEventManager)
+}
+
+func TestPublishEvents(t *testing.T) {
+	events := newSqliteEventManager()
+
+	published := []Event{
+		NewEvent("notice", "hello"),
+		NewItemEvent("update", []Item{NewItem(1, 2, "Bush")}),
+	}
+	for i, e := range published {
+		if err := events.Publish([]string{"staff", "public"}[i], e); err != nil {
+			t.Fatalf("events.Publish() failed: %v", err)
+		}
+	}
+
+	got, err := events.Since("public", 0)
+	if err != nil {
+		t.Fatalf("events.Since() failed: %v", err)
+	}
+
+	want := []Event{{ID: 2, Type: "update", Items: []Item{{BeerID: 1, BarID: 2, Data: `"Bush"`}}}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("events.Since(public, 0) = %v; got %v", want, got)
+	}
+
+	if got, _ := events.Since("public", 2); len(got) != 0 {
+		t.Errorf("events.Since(public, 2) = []; got %v", got)
+	}
+
+	if got, _ := events.LastID(); got != 2 {
+		t.Errorf("events.LastID() = 2; got %v", got)
+	}
+}
+
+func TestLeases(t *testing.T) {
+	events := newSqliteEventManager()
+	start := time.Unix(1000, 0)
+
+	tests := []struct {
+		holder string
+		after  time.Duration
+		want   bool
+	}{
+		{"a", 0, true},
+		{"b", 10 * time.Second, false},
+		{"a", 10 * time.Second, true},
+		{"b", 39 * time.Second, false},
+		{"b", 41 * time.Second, true},
+		{"a", 42 * time.Second, false},
+	}
+
+	for _, test := range tests {
+		got, err := events.AcquireLease("scheduler", test.holder, start.Add(test.after), 30*time.Second)
+		if err != nil {
+			t.Fatalf("events.AcquireLease() failed: %v", err)
+		}
+		if got != test.want {
+			t.Errorf("events.AcquireLease(%v, +%v) = %v; got %v", test.holder, test.after, test.want, got)
+		}
+	}
+
+	if err := events.ReleaseLease("scheduler", "b"); err != nil {
+		t.Fatalf("events.ReleaseLease() failed: %v", err)
+	}
+	if got, _ := events.AcquireLease("scheduler", "a", start.Add(43*time.Second), 30*time.Second); !got {
+		t.Error("a released lease should be acquirable")
+	}
+}
+
+func TestRecordAudit(t *testing.T) {
+	db, err := NewSqliteDatabase(":memory:")
+	if err != nil {
+		t.Fatalf("NewSqliteDatabase() failed: %v", err)
+	}
+
+	entries := []AuditEntry{
+		{Timestamp: time.Unix(900, 0), Action: "login_failed", Target: "admin", IP: "1.2.3.4"},
+		{Timestamp: time.Unix(960, 0), ActorID: 1, Action: "user_created", Target: "bob"},
+	}
+	for i := range entries {
+		if err := db.Audit.Record(&entries[i]); err != nil {
+			t.Errorf("audit.Record() failed: %v", err)
+		}
+		if entries[i].ID != uint(i+1) {
+			t.Errorf("entry.ID = %v; got %v", i+1, entries[i].ID)
+		}
+	}
+
+	users := db.Users.(*sqliteUserManager)
+	var actor sql.NullInt64
+	if err := users.db.QueryRow("SELECT actor_id FROM audit WHERE id = 1").Scan(&actor); err != nil || actor.Valid {
+		t.Errorf("unknown actor should be NULL; got %v (%v)", actor, err)
+	}
+}
+
+func TestFindAudit(t *testing.T) {
+	db, err := NewSqliteDatabase(":memory:")
+	if err != nil {
+		t.Fatalf("NewSqliteDatabase() failed: %v", err)
+	}
+
+	entries := []AuditEntry{
+		{Timestamp: time.Unix(900, 0), Action: "login_failed", Target: "admin"},
+		{Timestamp: time.Unix(960, 0), ActorID: 1, Action: "login", Target: "user 1"},
+		{Timestamp: time.Unix(1020, 0), ActorID: 1, Action: "user_created", Target: "user 2"},
+		{Timestamp: time.Unix(1080, 0), ActorID: 2, Action: "order", Target: "order 1"},
+	}
+	for i := range entries {
+		if err := db.Audit.Record(&entries[i]); err != nil {
+			t.Fatalf("audit.Record() failed: %v", err)
+		}
+	}
+
+	tests := []struct {
+		query AuditQuery
+		want  []uint
+	}{
+		{AuditQuery{Limit: 10}, []uint{4, 3, 2, 1}},
+		{AuditQuery{ActorID: 1, Limit: 10}, []uint{3, 2}},
+		{AuditQuery{Actions: []string{"login", "order"}, Limit: 10}, []uint{4, 2}},
+		{AuditQuery{Target: "admin", Limit: 10}, []uint{1}},
+		{AuditQuery{Since: time.Unix(960, 0), Until: time.Unix(1080, 0), Limit: 10}, []uint{3, 2}},
+		{AuditQuery{Limit: 2}, []uint{4, 3}},
+		{AuditQuery{Before: 3, Limit: 2}, []uint{2, 1}},
+	}
+
+	for _, test := range tests {
+		got, err := db.Audit.Find(test.query)
+		if err != nil {
+			t.Errorf("audit.Find(%+v) failed: %v", test.query, err)
+			continue
+		}
+
+		ids := []uint{}
+		for _, e := range got {
+			ids = append(ids, e.ID)
+		}
+		if !reflect.DeepEqual(ids, test.want) {
+			t.Errorf("audit.Find(%+v) = %v; got %v", test.query, test.want, ids)
+		}
+	}
+}
+
+func TestTerminals(t *testing.T) {
+	db, err := NewSqliteDatabase(":memory:")
+	if err != nil {
+		t.Fatalf("NewSqliteDatabase() failed: %v", err)
+	}
+
+	terminal, secret, err := db.Terminals.Create("Bar 1")
+	if err != nil {
+		t.Fatalf("terminals.Create() failed: %v", err)
+	}
+
+	if got, err := db.Terminals.BySecret(secret); err != nil || got.ID != terminal.ID {
+		t.Errorf("terminals.BySecret() = %v; got %v (%v)", terminal.ID, got.ID, err)
+	}
+	if _, err := db.Terminals.BySecret(hashToken(secret)); err == nil {
+		t.Errorf("terminals.BySecret() succeeded but shouldn't")
+	}
+
+	user := User{Name: "bob", Role: RoleBartender}
+	user.SetPassword("password")
+	if err := db.Users.Create(&user); err != nil {
+		t.Fatalf("users.Create() failed: %v", err)
+	}
+	token, err := db.Users.CreateToken(user.ID, terminal.ID, terminal.Name, time.Hour)
+	if err != nil {
+		t.Fatalf("users.CreateToken() failed: %v", err)
+	}
+
+	// Tokens bound to a terminal need its secret.
+	tests := []struct {
+		terminal string
+		ok       bool
+	}{
+		{"", false},
+		{"wrong", false},
+		{secret, true},
+	}
+	for _, test := range tests {
+		if _, err := db.Users.ByToken(token, test.terminal); (err == nil) != test.ok {
+			t.Errorf("users.ByToken(%q) succeeded = %v; got %v", test.terminal, test.ok, err == nil)
+		}
+	}
+
+	// Deleting the terminal deletes its tokens.
+	if found, err := db.Terminals.Delete(terminal.ID); err != nil || !found {
+		t.Errorf("terminals.Delete() = true; got %v (%v)", found, err)
+	}
+	if tokens, err := db.Users.Tokens(user.ID); err != nil || len(tokens) != 0 {
+		t.Errorf("users.Tokens() = []; got %v (%v)", tokens, err)
+	}
+}
+
+func TestUserByBadge(t *testing.T) {
+	defer func(secret []byte) { badgeSecret = secret }(badgeSecret)
+	badgeSecret = []byte("secret")
+
+	users := newSqliteUserManager()
+	users.mustExec("testing/insert-users")
+
+	user, err := users.ByID(2)
+	if err != nil {
+		t.Fatalf("users.ByID() failed: %v", err)
+	}
+	user.SetBadge("04A224B2C35E80")
+	user.SetPIN("1234")
+	if err := users.Update(&user); err != nil {
+		t.Fatalf("users.Update() failed: %v", err)
+	}
+
+	got, err := users.ByBadge("04A224B2C35E80")
+	if err != nil {
+		t.Errorf("users.ByBadge() failed: %v", err)
+	}
+	if !reflect.DeepEqual(got, user) {
+		t.Errorf("users.ByBadge() = %v; got %v", user, got)
+	}
+	if !got.CheckPIN("1234") {
+		t.Errorf("user.CheckPIN() failed but shouldn't")
+	}
+
+	if _, err := users.ByBadge(""); err == nil {
+		t.Errorf("users.ByBadge(\"\") succeeded but shouldn't")
+	}
+
+	badgeSecret = []byte("another secret")
+	if _, err := users.ByBadge("04A224B2C35E80"); err == nil {
+		t.Errorf("users.ByBadge() succeeded with another secret but shouldn't")
+	}
+}
+
+func TestAPIKeys(t *testing.T) {
+	db, err := NewSqliteDatabase(":memory:")
+	if err != nil {
+		t.Fatalf("NewSqliteDatabase() failed: %v", err)
+	}
+
+	key := APIKey{Name: "Display", Scopes: []Scope{ScopeReadEvents, ScopeOrder}, Bars: []uint{3, 1}}
+	value, err := db.APIKeys.Create(&key)
+	if err != nil {
+		t.Fatalf("apiKeys.Create() failed: %v", err)
+	}
+
+	past := time.Now().Add(-time.Hour)
+	expired := APIKey{Name: "Old bot", Scopes: []Scope{ScopeStats}, Expires: &past}
+	expiredValue, err := db.APIKeys.Create(&expired)
+	if err != nil {
+		t.Fatalf("apiKeys.Create() failed: %v", err)
+	}
+
+	got, err := db.APIKeys.ByKey(value)
+	if err != nil {
+		t.Fatalf("apiKeys.ByKey() failed: %v", err)
+	}
+	want := []Scope{ScopeReadEvents, ScopeOrder}
+	if got.ID != key.ID || !reflect.DeepEqual(got.Scopes, want) || !reflect.DeepEqual(got.Bars, []uint{1, 3}) || got.Expires != nil {
+		t.Errorf("apiKeys.ByKey() = {ID: %v, Scopes: %v, Bars: [1 3]}; got %+v", key.ID, want, got)
+	}
+	if _, err := db.APIKeys.ByKey(hashToken(value)); err == nil {
+		t.Errorf("apiKeys.ByKey() succeeded with the hash but shouldn't")
+	}
+	if _, err := db.APIKeys.ByKey(expiredValue); err == nil {
+		t.Errorf("apiKeys.ByKey() succeeded with an expired key but shouldn't")
+	}
+
+	// Orders made with API keys have no user.
+	if err := db.Beers.CreateOrder(&Order{UserID: got.User().ID, Timestamp: time.Now()}); err != nil {
+		t.Errorf("beers.CreateOrder() failed: %v", err)
+	}
+
+	if found, err := db.APIKeys.Delete(key.ID); err != nil || !found {
+		t.Errorf("apiKeys.Delete() = true; got %v (%v)", found, err)
+	}
+	if found, err := db.APIKeys.Delete(key.ID); err != nil || found {
+		t.Errorf("apiKeys.Delete() = false; got %v (%v)", found, err)
+	}
+	if keys, err := db.APIKeys.All(); err != nil || len(keys) != 1 || keys[0].ID != expired.ID {
+		t.Errorf("apiKeys.All() = [%v]; got %v (%v)", expired.ID, keys, err)
 	}
 }
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// errShuttingDown is returned by placeOrder once the server started
+	// shutting down.
+	errShuttingDown = errors.New("shutting down")
+
+	// errWrongBar is returned by placeOrder when a user orders a beer from a
+	// bar they don't work at.
+	errWrongBar = errors.New("wrong bar")
+)
+
+// Streams are the event streams clients can listen to.
+//
+// The public one only carries what customers see: prices and availability.
+// The staff one, which requires authentication, carries who ordered what,
+// stock alerts and admin notices.
+type Streams struct {
+	Deltas   *BeerDeltas
+	Public   Broker
+	Staff    Broker
+	draining int32
+}
+
+// NewStreams creates the event streams, starting from the given beers. Their
+// brokers are created by newBroker, on the "public" and "staff" channels.
+func NewStreams(beers []Beer, newBroker BrokerFunc) (*Streams, error) {
+	var err error
+	s := &Streams{Deltas: NewBeerDeltas(beers)}
+
+	s.Public, err = newBroker("public", func() (Event, error) {
+		return s.Deltas.Snapshot(), nil
+	}, s.Deltas.Convert)
+	if err != nil {
+		return nil, err
+	}
+
+	s.Staff, err = newBroker("staff", func() (Event, error) {
+		return stockEvent("snapshot", s.Deltas.Beers(), nil), nil
+	}, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// Drain tells that the server is shutting down: orders are not accepted
+// anymore, but events are still sent until Close is called.
+func (s *Streams) Drain() {
+	atomic.StoreInt32(&s.draining, 1)
+}
+
+// Draining tells if Drain was called.
+func (s *Streams) Draining() bool {
+	return atomic.LoadInt32(&s.draining) == 1
+}
+
+// Close closes both streams, telling clients to reconnect after retry.
+func (s *Streams) Close(retry time.Duration) {
+	s.Drain()
+	s.Public.Close(retry)
+	s.Staff.Close(retry)
+}
+
+// UpdateBeers broadcasts what changed in beers to the public stream.
+func (s *Streams) UpdateBeers(beers []Beer) {
+	s.Public.Broadcast(BeersEvent(beers))
+}
+
+// Ordered broadcasts an order made by a user, along with the beers as they
+// are after the order. Beers that start running out because of it are
+// reported to the staff as a "stock" event.
+func (s *Streams) Ordered(order Order, user User, beers []Beer) {
+	byID := map[uint]Beer{}
+	for _, beer := range beers {
+		byID[beer.ID] = beer
+	}
+
+	items := []Item{}
+	ordered := map[uint]int{}
+	for _, line := range order.Lines {
+		beer, ok := byID[line.ID]
+		if !ok {
+			continue // invalid IDs are ignored
+		}
+
+		items = append(items, NewItem(beer.ID, beer.BarID, staffOrderLine{
+			OrderID:         order.ID,
+			UserID:          user.ID,
+			UserName:        user.Name,
+			ID:              line.ID,
+			OrderedQuantity: line.OrderedQuantity,
+		}))
+		ordered[line.ID] += line.OrderedQuantity
+	}
+
+	s.UpdateBeers(beers)
+	s.Staff.Broadcast(NewItemEvent("order", items))
+
+	if e := stockEvent("stock", beers, ordered); len(e.Items) > 0 {
+		s.Staff.Broadcast(e)
+	}
+}
+
+// Notify sends a notice from an admin to the staff.
+func (s *Streams) Notify(user User, message string) {
+	s.Staff.Broadcast(NewEvent("notice", staffNotice{
+		UserID:   user.ID,
+		UserName: user.Name,
+		Message:  message,
+	}))
+}
+
+// staffOrderLine is an order line as sent to the staff.
+type staffOrderLine struct {
+	OrderID         uint   `json:"orderId"`
+	UserID          uint   `json:"userId"`
+	UserName        string `json:"userName"`
+	ID              uint   `json:"id"`
+	OrderedQuantity int    `json:"orderedQuantity"`
+}
+
+// stockAlert tells the staff that a beer is running out.
+type stockAlert struct {
+	ID        uint   `json:"id"`
+	Name      string `json:"name"`
+	Remaining int    `json:"remaining"`
+}
+
+// staffNotice is a message from an admin to the staff.
+type staffNotice struct {
+	UserID   uint   `json:"userId"`
+	UserName string `json:"userName"`
+	Message  string `json:"message"`
+}
+
+// stockEvent creates an event made of an alert per beer running out. If
+// ordered quantities are given, only the beers that just started running out
+// because of them are included.
+func stockEvent(eventType string, beers []Beer, ordered map[uint]int) Event {
+	items := []Item{}
+	for _, beer := range beers {
+		remaining := beer.Remaining()
+		if !beer.LowStock(remaining) {
+			continue
+		}
+		if ordered != nil && (ordered[beer.ID] <= 0 || beer.LowStock(remaining+ordered[beer.ID])) {
+			continue
+		}
+
+		items = append(items, NewItem(beer.ID, beer.BarID, stockAlert{
+			ID:        beer.ID,
+			Name:      beer.Name,
+			Remaining: remaining,
+		}))
+	}
+	return NewItemEvent(eventType, items)
+}
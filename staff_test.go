@@ -0,0 +1,75 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestStockEvent(t *testing.T) {
+	beers := []Beer{
+		{ID: 1, Name: "Bush", StockQuantity: 100, TotalSoldQuantity: 50},
+		{ID: 2, Name: "TK", StockQuantity: 100, TotalSoldQuantity: 92},
+		{ID: 3, Name: "Kwak", StockQuantity: 100, TotalSoldQuantity: 100},
+	}
+
+	tests := []struct {
+		ordered map[uint]int
+		want    string
+	}{
+		{nil, `[{"id":2,"name":"TK","remaining":8},{"id":3,"name":"Kwak","remaining":0}]`},
+		{map[uint]int{1: 10, 2: 5}, `[{"id":2,"name":"TK","remaining":8}]`},
+		{map[uint]int{2: 1, 3: 2}, `[]`},
+		{map[uint]int{2: -5}, `[]`},
+	}
+
+	for _, test := range tests {
+		if got := stockEvent("stock", beers, test.ordered).Payload(); got != test.want {
+			t.Errorf("stockEvent(%v) = %v; got %v", test.ordered, test.want, got)
+		}
+	}
+}
+
+func TestStreamsOrdered(t *testing.T) {
+	beers := []Beer{{ID: 1, BarID: 2, Name: "Bush", StockQuantity: 10}}
+	s, err := NewStreams(beers, MemoryBrokers(Disconnect))
+	if err != nil {
+		t.Fatalf("NewStreams() failed: %v", err)
+	}
+
+	public, _ := s.Public.Subscribe(0, Filter{})
+	defer s.Public.Unsubscribe(public)
+	staff, _ := s.Staff.Subscribe(0, Filter{})
+	defer s.Staff.Unsubscribe(staff)
+
+	beers[0].TotalSoldQuantity = 9
+	order := Order{ID: 4, Lines: []OrderLine{{ID: 1, OrderedQuantity: 9}, {ID: 5, OrderedQuantity: 1}}}
+	s.Ordered(order, User{ID: 3, Name: "bob"}, beers)
+
+	want := `{"version":1,"previous":0,"beers":[{"id":1,"totalSoldQuantity":9}]}`
+	if got := (<-public).Payload(); got != want {
+		t.Errorf("public event = %v; got %v", want, got)
+	}
+
+	wants := []string{
+		`[{"orderId":4,"userId":3,"userName":"bob","id":1,"orderedQuantity":9}]`,
+		`[{"id":1,"name":"Bush","remaining":1}]`,
+	}
+	for _, want := range wants {
+		if got := (<-staff).Payload(); got != want {
+			t.Errorf("staff event = %v; got %v", want, got)
+		}
+	}
+}
+
+func TestPlaceOrderAtWrongBar(t *testing.T) {
+	beers := &listBeerManager{}
+	beers.set(Beer{ID: 1, BarID: 2, Name: "Bush"})
+	s, err := NewStreams(nil, MemoryBrokers(Disconnect))
+	if err != nil {
+		t.Fatalf("NewStreams() failed: %v", err)
+	}
+
+	lines := []OrderLine{{ID: 1, OrderedQuantity: 1}}
+	if _, err := placeOrder(beers, s, User{ID: 2, Bars: []uint{1, 3}}, lines); err != errWrongBar {
+		t.Errorf("placeOrder() = %v; got %v", errWrongBar, err)
+	}
+}
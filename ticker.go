@@ -0,0 +1,366 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// notableMove is the relative price change from which a move is shown in
+	// the Atom feed.
+	notableMove = 0.1
+
+	// tickerMoves is the number of notable moves kept for the Atom feed.
+	tickerMoves = 50
+)
+
+// Ticker provides read-only feeds of the market, for screens and phones. It
+// follows the public broker's updates and reads beers with BeerManager.All
+// once per update, whatever the number of text clients.
+type Ticker struct {
+	beers   BeerManager
+	broker  Broker
+	mu      sync.Mutex
+	prices  map[uint]float64
+	moves   []Move
+	market  []Beer // as of the last update
+	clients map[chan []Beer]bool
+	stopped bool
+}
+
+// Move is a notable change of a beer's price.
+type Move struct {
+	BeerID uint
+	Name   string
+	From   float64
+	To     float64
+	Time   time.Time
+}
+
+// Change returns the relative change of a move.
+func (m Move) Change() float64 {
+	return (m.To - m.From) / m.From
+}
+
+// NewTicker creates a ticker. It starts a new goroutine that records notable
+// moves until the broker is closed.
+func NewTicker(beers BeerManager, broker Broker) (*Ticker, error) {
+	all, err := beers.All()
+	if err != nil {
+		return nil, err
+	}
+
+	t := &Ticker{beers: beers, broker: broker, prices: map[uint]float64{}, market: all, clients: map[chan []Beer]bool{}}
+	for _, beer := range all {
+		t.prices[beer.ID] = beer.SellingPrice
+	}
+
+	c, _ := broker.Subscribe(0, tickerFilter)
+	go t.follow(c)
+
+	return t, nil
+}
+
+// tickerFilter selects the events the ticker follows.
+var tickerFilter = Filter{Types: map[string]bool{"update": true}}
+
+// follow records notable moves on every update received on c, until the
+// broker is closed, and then disconnects text clients. If the ticker is
+// evicted for being too slow, it subscribes again: prices are compared with
+// the last known ones, so missing updates doesn't matter.
+func (t *Ticker) follow(c chan Event) {
+	defer t.stop()
+
+	for {
+		received := false
+		for e := range c {
+			received = true
+			if e.Type == "shutdown" {
+				continue
+			}
+			if err := t.record(time.Now()); err != nil {
+				log.Printf("ticker: %v", err)
+			}
+		}
+		t.broker.Unsubscribe(c)
+
+		// Evicted clients have a full queue to read first, whereas closed
+		// brokers disconnect new clients right away.
+		if !received {
+			return
+		}
+		c, _ = t.broker.Subscribe(0, tickerFilter)
+	}
+}
+
+// subscribe registers a text client. It returns the channel on which the
+// market is sent after every update, along with its current state. The
+// channel is closed when the broker is.
+func (t *Ticker) subscribe() (chan []Beer, []Beer) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	c := make(chan []Beer, 1)
+	if t.stopped {
+		close(c)
+	} else {
+		t.clients[c] = true
+	}
+	return c, t.market
+}
+
+// unsubscribe removes a text client registered with subscribe.
+func (t *Ticker) unsubscribe(c chan []Beer) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.clients, c)
+}
+
+// stop disconnects text clients.
+func (t *Ticker) stop() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for c := range t.clients {
+		close(c)
+	}
+	t.clients = map[chan []Beer]bool{}
+	t.stopped = true
+}
+
+// Moves returns the last notable moves, most recent first.
+func (t *Ticker) Moves() []Move {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([]Move{}, t.moves...)
+}
+
+// record compares beers' prices with the last known ones, records notable
+// moves and sends the market to text clients.
+func (t *Ticker) record(now time.Time) error {
+	beers, err := t.beers.All()
+	if err != nil {
+		return err
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	// Slow clients only miss intermediate states, as they are replaced by the
+	// latest one.
+	t.market = beers
+	for c := range t.clients {
+		select {
+		case <-c:
+		default:
+		}
+		c <- beers
+	}
+
+	for _, beer := range beers {
+		from, ok := t.prices[beer.ID]
+		t.prices[beer.ID] = beer.SellingPrice
+		if !ok || from == 0 || from == beer.SellingPrice {
+			continue
+		}
+
+		move := Move{BeerID: beer.ID, Name: beer.Name, From: from, To: beer.SellingPrice, Time: now}
+		if math.Abs(move.Change()) >= notableMove {
+			t.moves = append([]Move{move}, t.moves...)
+		}
+	}
+
+	if len(t.moves) > tickerMoves {
+		t.moves = t.moves[:tickerMoves]
+	}
+
+	return nil
+}
+
+// ServeText is a handler function that streams the market as plain text: a
+// line with every beer's price and last change, whenever prices change. With
+// the "color" query parameter, changes are colored with ANSI escape codes.
+// The "bar" and "beer" query parameters are supported (see ParseFilter).
+func (t *Ticker) ServeText(c *gin.Context) {
+	filter, err := ParseFilter(c)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "bad_request"})
+		return
+	}
+
+	color := c.Query("color") != ""
+	market, beers := t.subscribe()
+	defer t.unsubscribe(market)
+
+	w := c.Writer
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	closed := w.CloseNotify()
+
+	last := ""
+	for {
+		// Orders trigger updates too, but they don't change prices.
+		if line := tickerLine(filterBeers(beers, filter), color); line != last {
+			if _, err := w.WriteString(line + "\n"); err != nil {
+				return // the client is gone
+			}
+			w.Flush()
+			last = line
+		}
+
+		var ok bool
+		select {
+		case beers, ok = <-market:
+			if !ok {
+				return // shutting down
+			}
+		case <-closed:
+			return
+		}
+	}
+}
+
+// tickerBeer is a beer as shown in the JSON feed.
+type tickerBeer struct {
+	ID     uint    `json:"id"`
+	Name   string  `json:"name"`
+	Price  float64 `json:"price"`
+	Change float64 `json:"change"`
+}
+
+// ServeJSON is a handler function that returns the market as compact JSON:
+// every beer's price and relative change since the previous period. The "bar"
+// and "beer" query parameters are supported (see ParseFilter).
+func (t *Ticker) ServeJSON(c *gin.Context) {
+	filter, err := ParseFilter(c)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "bad_request"})
+		return
+	}
+
+	beers, err := t.beers.All()
+	if err != nil {
+		panic(err)
+	}
+
+	feed := []tickerBeer{}
+	for _, beer := range filterBeers(beers, filter) {
+		feed = append(feed, tickerBeer{
+			ID:     beer.ID,
+			Name:   beer.Name,
+			Price:  math.Round(beer.SellingPrice*100) / 100,
+			Change: math.Round(priceChange(beer)*1000) / 1000,
+		})
+	}
+
+	c.JSON(http.StatusOK, feed)
+}
+
+// atomFeed and atomEntry are the parts of an Atom feed that we use.
+type (
+	atomFeed struct {
+		XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+		ID      string      `xml:"id"`
+		Title   string      `xml:"title"`
+		Updated string      `xml:"updated"`
+		Entries []atomEntry `xml:"entry"`
+	}
+
+	atomEntry struct {
+		ID      string `xml:"id"`
+		Title   string `xml:"title"`
+		Updated string `xml:"updated"`
+		Summary string `xml:"summary"`
+	}
+)
+
+// ServeAtom is a handler function that returns the last notable moves as an
+// Atom feed.
+func (t *Ticker) ServeAtom(c *gin.Context) {
+	moves := t.Moves()
+	feed := atomFeed{
+		ID:      "urn:boursiere:moves",
+		Title:   "La Boursière",
+		Updated: time.Now().UTC().Format(time.RFC3339),
+		Entries: []atomEntry{},
+	}
+	if len(moves) > 0 {
+		feed.Updated = moves[0].Time.UTC().Format(time.RFC3339)
+	}
+
+	for _, m := range moves {
+		feed.Entries = append(feed.Entries, atomEntry{
+			ID:      fmt.Sprintf("urn:boursiere:moves:%v:%v", m.BeerID, m.Time.UnixMilli()),
+			Title:   fmt.Sprintf("%s %s %+.0f%%", m.Name, arrow(m.Change()), m.Change()*100),
+			Updated: m.Time.UTC().Format(time.RFC3339),
+			Summary: fmt.Sprintf("%s went from %.2f to %.2f.", m.Name, m.From, m.To),
+		})
+	}
+
+	data, err := xml.MarshalIndent(feed, "", "  ")
+	if err != nil {
+		panic(err)
+	}
+
+	c.Data(http.StatusOK, "application/atom+xml; charset=utf-8", append([]byte(xml.Header), data...))
+}
+
+// tickerLine formats beers as a single ticker line.
+func tickerLine(beers []Beer, color bool) string {
+	parts := make([]string, len(beers))
+	for i, beer := range beers {
+		change := priceChange(beer)
+		move := fmt.Sprintf("%s %+.1f%%", arrow(change), change*100)
+		if color && change > 0 {
+			move = "\x1b[32m" + move + "\x1b[0m"
+		} else if color && change < 0 {
+			move = "\x1b[31m" + move + "\x1b[0m"
+		}
+
+		parts[i] = fmt.Sprintf("%s %.2f %s", beer.Name, beer.SellingPrice, move)
+	}
+	return strings.Join(parts, "  |  ")
+}
+
+// priceChange returns the relative change of a beer's price since the
+// previous period.
+func priceChange(b Beer) float64 {
+	if b.PreviousSellingPrice == 0 {
+		return 0
+	}
+	return (b.SellingPrice - b.PreviousSellingPrice) / b.PreviousSellingPrice
+}
+
+// arrow returns a symbol representing a change.
+func arrow(change float64) string {
+	switch {
+	case change > 0:
+		return "▲"
+	case change < 0:
+		return "▼"
+	default:
+		return "="
+	}
+}
+
+// filterBeers returns the beers matching a filter's bars and beers.
+func filterBeers(beers []Beer, filter Filter) []Beer {
+	if filter.Bars == nil && filter.Beers == nil {
+		return beers
+	}
+
+	filtered := []Beer{}
+	for _, beer := range beers {
+		if filter.Bars[beer.BarID] || filter.Beers[beer.ID] {
+			filtered = append(filtered, beer)
+		}
+	}
+	return filtered
+}
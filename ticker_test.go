@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// listBeerManager is a BeerManager whose beers are set by tests.
+type listBeerManager struct {
+	BeerManager
+	mu    sync.Mutex
+	beers []Beer
+}
+
+func (m *listBeerManager) All() ([]Beer, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]Beer{}, m.beers...), nil
+}
+
+func (m *listBeerManager) set(beers ...Beer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.beers = beers
+}
+
+func TestTickerRecordsNotableMoves(t *testing.T) {
+	beers := &listBeerManager{}
+	beers.set(Beer{ID: 1, Name: "Bush", SellingPrice: 2}, Beer{ID: 2, Name: "TK", SellingPrice: 1})
+
+	ticker, err := NewTicker(beers, newTestBroker(Disconnect))
+	if err != nil {
+		t.Fatalf("NewTicker() failed: %v", err)
+	}
+
+	now := time.Unix(900, 0)
+	beers.set(Beer{ID: 1, Name: "Bush", SellingPrice: 2.1}, Beer{ID: 2, Name: "TK", SellingPrice: 0.8})
+	ticker.record(now)
+	beers.set(Beer{ID: 1, Name: "Bush", SellingPrice: 2.4}, Beer{ID: 2, Name: "TK", SellingPrice: 0.8})
+	ticker.record(now.Add(time.Minute))
+
+	want := []Move{
+		{BeerID: 1, Name: "Bush", From: 2.1, To: 2.4, Time: now.Add(time.Minute)},
+		{BeerID: 2, Name: "TK", From: 1, To: 0.8, Time: now},
+	}
+	got := ticker.Moves()
+	if len(got) != len(want) || got[0] != want[0] || got[1] != want[1] {
+		t.Errorf("ticker.Moves() = %v; got %v", want, got)
+	}
+
+	gin.SetMode(gin.TestMode)
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	ticker.ServeAtom(c)
+
+	for _, s := range []string{"<title>Bush ▲ +14%</title>", "<title>TK ▼ -20%</title>", "<updated>1970-01-01T00:16:00Z</updated>"} {
+		if !strings.Contains(w.Body.String(), s) {
+			t.Errorf("ticker.ServeAtom() should contain %v; got %v", s, w.Body.String())
+		}
+	}
+}
+
+// gatedBeerManager is a listBeerManager whose All waits while gate is locked.
+type gatedBeerManager struct {
+	listBeerManager
+	gate sync.Mutex
+}
+
+func (m *gatedBeerManager) All() ([]Beer, error) {
+	m.gate.Lock()
+	defer m.gate.Unlock()
+	return m.listBeerManager.All()
+}
+
+func TestTickerFollowsAfterEviction(t *testing.T) {
+	beers := &gatedBeerManager{}
+	beers.set(Beer{ID: 1, Name: "Bush", SellingPrice: 2})
+	b := newTestBroker(Disconnect)
+
+	ticker, err := NewTicker(beers, b)
+	if err != nil {
+		t.Fatalf("NewTicker() failed: %v", err)
+	}
+
+	// The ticker is stuck on the first update while the others fill its queue.
+	beers.gate.Lock()
+	for i := 0; i < queueSize+5; i++ {
+		b.Broadcast(NewEvent("update", i))
+	}
+	broadcastN(b, 1)
+	if stats := b.Stats(); stats.Evicted != 1 {
+		t.Fatalf("b.Stats() = {Evicted: 1}; got %+v", stats)
+	}
+	beers.gate.Unlock()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for b.Stats().Clients != 1 {
+		if time.Now().After(deadline) {
+			t.Fatalf("the ticker didn't subscribe again")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	beers.set(Beer{ID: 1, Name: "Bush", SellingPrice: 3})
+	b.Broadcast(NewEvent("update", "new price"))
+	for len(ticker.Moves()) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("ticker.Moves() should have a move after the eviction")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// countingBeerManager is a listBeerManager that counts calls to All.
+type countingBeerManager struct {
+	listBeerManager
+	calls int32
+}
+
+func (m *countingBeerManager) All() ([]Beer, error) {
+	atomic.AddInt32(&m.calls, 1)
+	return m.listBeerManager.All()
+}
+
+func TestTickerServeText(t *testing.T) {
+	beers := &countingBeerManager{}
+	beers.set(Beer{ID: 1, Name: "Bush", SellingPrice: 2})
+	b := newTestBroker(Disconnect)
+
+	ticker, err := NewTicker(beers, b)
+	if err != nil {
+		t.Fatalf("NewTicker() failed: %v", err)
+	}
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.GET("/ticker", ticker.ServeText)
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	clients := make([]*bufio.Reader, 3)
+	for i := range clients {
+		res, err := http.Get(server.URL + "/ticker")
+		if err != nil {
+			t.Fatalf("http.Get() failed: %v", err)
+		}
+		defer res.Body.Close()
+		clients[i] = bufio.NewReader(res.Body)
+	}
+
+	read := func(want string) {
+		t.Helper()
+		for i, r := range clients {
+			if got, err := r.ReadString('\n'); got != want || err != nil {
+				t.Errorf("#%v: line = %q; got %q (%v)", i, want, got, err)
+			}
+		}
+	}
+
+	read("Bush 2.00 = +0.0%\n")
+	beers.set(Beer{ID: 1, Name: "Bush", SellingPrice: 2.2, PreviousSellingPrice: 2})
+	b.Broadcast(NewEvent("update", "new price"))
+	read("Bush 2.20 ▲ +10.0%\n")
+
+	// Beers are read once upon creation and once per update, not per client.
+	if calls := atomic.LoadInt32(&beers.calls); calls != 2 {
+		t.Errorf("beers.All() calls = 2; got %v", calls)
+	}
+
+	b.Close(time.Second)
+	for i, r := range clients {
+		if _, err := r.ReadString('\n'); err != io.EOF {
+			t.Errorf("#%v: stream should end on shutdown; got %v", i, err)
+		}
+	}
+}
+
+func TestTickerLine(t *testing.T) {
+	beers := []Beer{
+		{Name: "Bush", SellingPrice: 2.2, PreviousSellingPrice: 2},
+		{Name: "TK", SellingPrice: 0.9, PreviousSellingPrice: 1},
+		{Name: "Kwak", SellingPrice: 3},
+	}
+
+	tests := []struct {
+		color bool
+		want  string
+	}{
+		{false, "Bush 2.20 ▲ +10.0%  |  TK 0.90 ▼ -10.0%  |  Kwak 3.00 = +0.0%"},
+		{true, "Bush 2.20 \x1b[32m▲ +10.0%\x1b[0m  |  TK 0.90 \x1b[31m▼ -10.0%\x1b[0m  |  Kwak 3.00 = +0.0%"},
+	}
+
+	for _, test := range tests {
+		if got := tickerLine(beers, test.color); got != test.want {
+			t.Errorf("tickerLine(color: %v) = %q; got %q", test.color, test.want, got)
+		}
+	}
+}
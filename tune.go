@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"errors"
+	"math"
+	"math/rand"
+)
+
+// expectation is the extra CSV column read by the tuning route and command.
+type expectation struct {
+	ExpectedQuantity int `csv:"expectedQuantity"`
+}
+
+var errBadExpectations = errors.New("missing or invalid expectedQuantity column")
+
+// loadTuneCSV parses a beer catalogue along with its expectedQuantity column,
+// which must be present, without negative quantities and not only hold zeros.
+func loadTuneCSV(data []byte) ([]Beer, []int, error) {
+	beers, err := LoadBeersFromCSV(bytes.NewReader(data))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	titles, err := csv.NewReader(bytes.NewReader(data)).Read()
+	if err != nil {
+		return nil, nil, err
+	}
+	found := false
+	for _, title := range titles {
+		found = found || title == "expectedQuantity"
+	}
+	if !found {
+		return nil, nil, errBadExpectations
+	}
+
+	var expectations []expectation
+	if err := UnmarshalCSV(bytes.NewReader(data), &expectations); err != nil {
+		return nil, nil, err
+	}
+
+	expected := make([]int, len(expectations))
+	total := 0
+	for i, e := range expectations {
+		if e.ExpectedQuantity < 0 {
+			return nil, nil, errBadExpectations
+		}
+		expected[i] = e.ExpectedQuantity
+		total += e.ExpectedQuantity
+	}
+	if total == 0 {
+		return nil, nil, errBadExpectations
+	}
+
+	return beers, expected, nil
+}
+
+// TuneTarget is what TuneCoefs aims for. Only one of its fields should be set:
+// if Margin is zero, Volatility is used.
+type TuneTarget struct {
+	// Margin is the profit divided by the purchase cost of sold beers.
+	Margin float64
+
+	// Volatility is the average relative price change from one period to the
+	// next.
+	Volatility float64
+}
+
+// Candidate values for IncrCoef and, multiplied by a ratio, DecrCoef.
+var (
+	tuneCoefs  = []float64{0.01, 0.02, 0.03, 0.04, 0.05, 0.06, 0.07, 0.08, 0.09, 0.1, 0.12, 0.14, 0.16, 0.18, 0.2, 0.25, 0.3}
+	tuneRatios = []float64{0.5, 0.75, 1, 1.25, 1.5}
+)
+
+// TuneCoefs searches IncrCoef and DecrCoef for every beer so that, if it sells
+// its expected quantity over the given number of periods, simulated prices
+// meet the target as closely as possible. Other fields are left as is.
+//
+// expected[i] is the quantity of beers[i] that is expected to be sold during
+// the whole event.
+func TuneCoefs(beers []Beer, expected []int, periods int, target TuneTarget) []Beer {
+	tuned := make([]Beer, len(beers))
+	for i, beer := range beers {
+		demand := simulateDemand(expected[i], periods, int64(i))
+
+		best := math.Inf(1)
+		for _, incr := range tuneCoefs {
+			for _, ratio := range tuneRatios {
+				b := beer
+				b.IncrCoef = incr
+				b.DecrCoef = math.Round(incr*ratio*100) / 100
+
+				score := tuneScore(b, demand, target)
+				if score < best {
+					best = score
+					tuned[i] = b
+				}
+			}
+		}
+	}
+
+	return tuned
+}
+
+// tuneScore simulates a beer's prices and returns how far they are from the
+// target. Lower is better.
+func tuneScore(b Beer, demand []Record, target TuneTarget) float64 {
+	b.ID = 0 // to match the simulated demand's records
+	replay := ReplayHistory([]Beer{b}, demand, strategies["default"])
+	r := replay.Beers[0]
+
+	if target.Margin != 0 {
+		cost := 0.0
+		for _, q := range r.SoldQuantities {
+			cost += float64(q) * b.PurchasePrice
+		}
+		if cost == 0 {
+			return 0
+		}
+		return math.Abs(r.SimulatedProfit/cost - target.Margin)
+	}
+
+	volatility := 0.0
+	for i := 1; i < len(r.SimulatedPrices); i++ {
+		volatility += math.Abs(r.SimulatedPrices[i]-r.SimulatedPrices[i-1]) / r.SimulatedPrices[i-1]
+	}
+	if len(r.SimulatedPrices) > 1 {
+		volatility /= float64(len(r.SimulatedPrices) - 1)
+	}
+	return math.Abs(volatility - target.Volatility)
+}
+
+// simulateDemand spreads an expected quantity over a number of periods. Sales
+// follow a bell curve peaking in the middle of the event, with some noise so
+// that prices move both ways. The same seed always gives the same demand.
+func simulateDemand(quantity, periods int, seed int64) []Record {
+	rng := rand.New(rand.NewSource(seed))
+
+	weights := make([]float64, periods)
+	total := 0.0
+	for i := range weights {
+		x := (float64(i) + 0.5) / float64(periods)
+		weights[i] = math.Exp(-math.Pow((x-0.5)/0.25, 2)/2) * (0.75 + rng.Float64()/2)
+		total += weights[i]
+	}
+
+	demand := make([]Record, periods)
+	for i, w := range weights {
+		demand[i].SoldQuantity = int(math.Round(float64(quantity) * w / total))
+	}
+
+	return demand
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"math"
+	"reflect"
+	"testing"
+)
+
+func TestLoadTuneCSV(t *testing.T) {
+	tests := []struct {
+		csv  string
+		want []int
+		err  error
+	}{
+		{
+			csv:  "name,expectedQuantity\nBush,200\nTK,50\n",
+			want: []int{200, 50},
+		},
+		{
+			csv:  "name,expectedQuantity\nBush,200\nTK,0\n",
+			want: []int{200, 0},
+		},
+		{
+			csv: "name\nBush\nTK\n",
+			err: errBadExpectations,
+		},
+		{
+			csv: "name,expectedQuantity\nBush,0\nTK,0\n",
+			err: errBadExpectations,
+		},
+		{
+			csv: "name,expectedQuantity\nBush,200\nTK,-50\n",
+			err: errBadExpectations,
+		},
+	}
+
+	for _, test := range tests {
+		_, got, err := loadTuneCSV([]byte(test.csv))
+		if err != test.err {
+			t.Errorf("loadTuneCSV(%q) error = %v; got %v", test.csv, test.err, err)
+		}
+
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("loadTuneCSV(%q) = %v; got %v", test.csv, test.want, got)
+		}
+	}
+}
+
+func TestSimulateDemand(t *testing.T) {
+	demand := simulateDemand(100, 10, 1)
+	if len(demand) != 10 {
+		t.Fatalf("len(simulateDemand()) = 10; got %v", len(demand))
+	}
+
+	total := 0
+	for _, r := range demand {
+		total += r.SoldQuantity
+	}
+	if total < 95 || total > 105 {
+		t.Errorf("total sold quantity = 100 (±5); got %v", total)
+	}
+}
+
+func TestTuneCoefs(t *testing.T) {
+	beers := []Beer{
+		{Name: "Bush", PurchasePrice: 1.3, MinCoef: 0.8, MaxCoef: 2.5},
+		{Name: "TK", PurchasePrice: 1.2, MinCoef: 0.8, MaxCoef: 2.5},
+	}
+	expected := []int{200, 50}
+
+	for _, margin := range []float64{0.1, 0.3} {
+		tuned := TuneCoefs(beers, expected, 24, TuneTarget{Margin: margin})
+		for i, b := range tuned {
+			if b.Name != beers[i].Name || b.MinCoef != beers[i].MinCoef || b.MaxCoef != beers[i].MaxCoef {
+				t.Errorf("TuneCoefs() modified other fields than coefficients: %v", b)
+			}
+
+			replay := ReplayHistory([]Beer{b}, simulateDemand(expected[i], 24, int64(i)), strategies["default"])
+			got := replay.SimulatedProfit / (float64(expected[i]) * b.PurchasePrice)
+			if math.Abs(got-margin) > 0.05 {
+				t.Errorf("simulated margin of %v = %v (±0.05); got %v", b.Name, margin, got)
+			}
+		}
+	}
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+	"github.com/gorilla/websocket"
+)
+
+// wsWriteTimeout is the time a WebSocket client has to accept a message.
+const wsWriteTimeout = 10 * time.Second
+
+var upgrader = websocket.Upgrader{
+	// Clients authenticate with tokens, not cookies, so there is no need to
+	// protect them against cross-site requests.
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
+
+// wsMessage is a message exchanged over a WebSocket, in either direction.
+//
+// Events are sent with their ID, type and data. Clients send "auth" messages
+// with a token and "order" messages with the same data as POST
+// /api/beers/order. Each of them is answered with an "ack" or an "error"
+// message carrying the same ref. They can also send "snapshot" messages,
+// which are answered with a snapshot event.
+type wsMessage struct {
+	ID    uint64          `json:"id,omitempty"`
+	Type  string          `json:"type"`
+	Ref   string          `json:"ref,omitempty"`
+	Token string          `json:"token,omitempty"`
+	Data  json.RawMessage `json:"data,omitempty"`
+	Error string          `json:"error,omitempty"`
+}
+
+// serveWebSocket is a handler function that sends public events over a
+// WebSocket, like Broker.ServeHTTP does over SSE, and lets authenticated
+// clients order beers.
+//
+// Clients are authenticated by the Authorization header, the "token" query
+// parameter or an "auth" message. Machine clients can use an API key instead,
+// as with auth. The "lastEventId" query parameter plays the role of the
+// Last-Event-ID header.
+func serveWebSocket(db Database, streams *Streams) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		filter, err := ParseFilter(c)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "bad_request"})
+			return
+		}
+
+		broker := streams.Public
+		client := wsClient{db: db, streams: streams, filter: filter, terminal: requestTerminal(c), ip: c.ClientIP()}
+		if value, ok := requestAPIKey(c); ok {
+			key, err := db.APIKeys.ByKey(value)
+			if err != nil {
+				c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "unauthenticated"})
+				return
+			}
+			u := key.User()
+			client.user, client.key = &u, &key
+		} else if token, ok := requestToken(c); ok {
+			u, err := db.Users.ByToken(token, requestTerminal(c))
+			if err != nil {
+				c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "unauthenticated"})
+				return
+			}
+			if u.MustChangePassword {
+				c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "password_change_required"})
+				return
+			}
+			client.user = &u
+		}
+
+		conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
+		if err != nil {
+			return // the upgrader already replied
+		}
+		defer conn.Close()
+
+		lastID, _ := strconv.ParseUint(c.Query("lastEventId"), 10, 64)
+		msgs, resume := broker.Subscribe(lastID, filter)
+		defer broker.Unsubscribe(msgs)
+
+		missed, err := broker.catchUp(resume, filter)
+		if err != nil {
+			panic(err)
+		}
+
+		// Messages are read in another goroutine but handled in this one, so
+		// that panics are recovered as usual.
+		incoming := make(chan wsMessage)
+		done := make(chan struct{})
+		stop := make(chan struct{})
+		defer close(stop)
+		go func() {
+			defer close(done)
+			for {
+				var msg wsMessage
+				if err := conn.ReadJSON(&msg); err != nil {
+					return
+				}
+				select {
+				case incoming <- msg:
+				case <-stop:
+					return
+				}
+			}
+		}()
+
+		heartbeat := time.NewTicker(heartbeatPeriod)
+		defer heartbeat.Stop()
+
+		write := func(msg wsMessage) bool {
+			conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+			return conn.WriteJSON(msg) == nil
+		}
+
+		for _, e := range missed {
+			if !write(eventMessage(e)) {
+				return
+			}
+		}
+
+		for {
+			select {
+			case e, ok := <-msgs:
+				if !ok {
+					// Evicted or shutting down: the client should reconnect.
+					msg := websocket.FormatCloseMessage(websocket.CloseTryAgainLater, "")
+					conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(wsWriteTimeout))
+					return
+				}
+				if e.ID <= client.snapshotID {
+					continue
+				}
+				if !write(eventMessage(e)) {
+					return
+				}
+			case msg := <-incoming:
+				if !write(client.handle(msg)) {
+					return
+				}
+			case <-heartbeat.C:
+				if conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(wsWriteTimeout)) != nil {
+					return
+				}
+			case <-done:
+				return
+			}
+		}
+	}
+}
+
+// eventMessage converts an event to a WebSocket message.
+func eventMessage(e Event) wsMessage {
+	return wsMessage{ID: e.ID, Type: e.Type, Data: json.RawMessage(e.Payload())}
+}
+
+// wsClient is the state of a WebSocket connection.
+type wsClient struct {
+	db      Database
+	streams *Streams
+	filter  Filter
+	user    *User // nil until authenticated
+
+	// key is the API key the client authenticated with, if any. The user
+	// then stands for it.
+	key *APIKey
+
+	// terminal is the secret of the terminal the client runs on, if any.
+	terminal string
+
+	// ip is the client's address, for the audit log.
+	ip string
+
+	// snapshotID is the ID of the last snapshot the client asked for. Queued
+	// events up to it are already part of it.
+	snapshotID uint64
+}
+
+// can tells if the authenticated client has a permission, like authorize.
+func (w *wsClient) can(perm Permission) bool {
+	if w.key != nil {
+		return w.key.Can(perm)
+	}
+	return w.user != nil && w.user.Role.Can(perm)
+}
+
+// handle handles a message sent by the client and returns the reply.
+func (w *wsClient) handle(msg wsMessage) wsMessage {
+	reply := wsMessage{Type: "ack", Ref: msg.Ref}
+	fail := func(err string) wsMessage {
+		return wsMessage{Type: "error", Ref: msg.Ref, Error: err}
+	}
+
+	switch msg.Type {
+	case "auth":
+		u, err := w.db.Users.ByToken(msg.Token, w.terminal)
+		if err != nil {
+			return fail("unauthenticated")
+		}
+		if u.MustChangePassword {
+			return fail("password_change_required")
+		}
+		w.user, w.key = &u, nil
+		return reply
+
+	case "order":
+		if w.user == nil {
+			return fail("unauthenticated")
+		}
+		if !w.can(PermOrder) {
+			return fail("unauthorized")
+		}
+
+		var req orderReq
+		if err := json.Unmarshal(msg.Data, &req); err != nil {
+			return fail("bad_request")
+		}
+		if err := binding.Validator.ValidateStruct(req); err != nil {
+			return fail("bad_request")
+		}
+
+		lines := make([]OrderLine, len(req))
+		for i, line := range req {
+			lines[i] = OrderLine(line)
+		}
+
+		order, err := placeOrder(w.db.Beers, w.streams, *w.user, lines)
+		if err == errShuttingDown {
+			return fail("shutting_down")
+		} else if err == errWrongBar {
+			return fail("wrong_bar")
+		} else if err != nil {
+			panic(err)
+		}
+
+		summary := orderSummary(lines)
+		if w.key != nil {
+			summary = apiKeySummary(*w.key, summary)
+		}
+		audit(w.db.Audit, w.ip, w.user.ID, "order", fmt.Sprintf("order %v", order.ID), summary)
+
+		reply.Data = json.RawMessage(marshal(gin.H{"orderId": order.ID}))
+		return reply
+
+	case "snapshot":
+		broker := w.streams.Public
+		w.snapshotID = broker.lastEventID()
+		snapshot, err := broker.catchUp(resume{lastID: w.snapshotID}, w.filter)
+		if err != nil {
+			panic(err)
+		}
+
+		reply = eventMessage(snapshot[0])
+		reply.Ref = msg.Ref
+		return reply
+
+	default:
+		return fail("bad_request")
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+)
+
+func TestServeWebSocket(t *testing.T) {
+	db, err := NewSqliteDatabase(path.Join(t.TempDir(), "db.sqlite3"))
+	if err != nil {
+		t.Fatalf("NewSqliteDatabase() failed: %v", err)
+	}
+
+	beer := Beer{Name: "Bush", BarID: 2, PurchasePrice: 1}
+	if err := db.Beers.Create(&beer, Period{}); err != nil {
+		t.Fatalf("beers.Create() failed: %v", err)
+	}
+
+	user := User{Name: "bob", Role: RoleBartender}
+	user.SetPassword("password")
+	if err := db.Users.Create(&user); err != nil {
+		t.Fatalf("users.Create() failed: %v", err)
+	}
+	token, err := db.Users.CreateToken(user.ID, 0, "", time.Hour)
+	if err != nil {
+		t.Fatalf("users.CreateToken() failed: %v", err)
+	}
+
+	beers, err := db.Beers.All()
+	if err != nil {
+		t.Fatalf("beers.All() failed: %v", err)
+	}
+
+	streams, err := NewStreams(beers, MemoryBrokers(Disconnect))
+	if err != nil {
+		t.Fatalf("NewStreams() failed: %v", err)
+	}
+	staff, _ := streams.Staff.Subscribe(0, Filter{})
+	defer streams.Staff.Unsubscribe(staff)
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.GET("/ws", serveWebSocket(db, streams))
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/ws", nil)
+	if err != nil {
+		t.Fatalf("Dial() failed: %v", err)
+	}
+	defer conn.Close()
+
+	send := func(msg string) wsMessage {
+		if err := conn.WriteMessage(websocket.TextMessage, []byte(msg)); err != nil {
+			t.Fatalf("conn.WriteMessage() failed: %v", err)
+		}
+		var reply wsMessage
+		if err := conn.ReadJSON(&reply); err != nil {
+			t.Fatalf("conn.ReadJSON() failed: %v", err)
+		}
+		return reply
+	}
+
+	var snapshot wsMessage
+	if err := conn.ReadJSON(&snapshot); err != nil || snapshot.Type != "snapshot" {
+		t.Fatalf("first message should be a snapshot; got %v (%v)", snapshot, err)
+	}
+
+	order := `{"type": "order", "ref": "a", "data": [{"id": 1, "orderedQuantity": 2}]}`
+	tests := []struct {
+		msg  string
+		want wsMessage
+	}{
+		{order, wsMessage{Type: "error", Ref: "a", Error: "unauthenticated"}},
+		{`{"type": "auth", "ref": "b", "token": "wrong"}`, wsMessage{Type: "error", Ref: "b", Error: "unauthenticated"}},
+		{`{"type": "auth", "ref": "c", "token": "` + token + `"}`, wsMessage{Type: "ack", Ref: "c"}},
+		{`{"type": "order", "ref": "d", "data": [{"id": 0}]}`, wsMessage{Type: "error", Ref: "d", Error: "bad_request"}},
+		{`{"type": "snapshot", "ref": "f"}`, wsMessage{Type: "snapshot", Ref: "f"}},
+		{`{"type": "dance", "ref": "e"}`, wsMessage{Type: "error", Ref: "e", Error: "bad_request"}},
+	}
+	for _, test := range tests {
+		if got := send(test.msg); got.Type != test.want.Type || got.Ref != test.want.Ref || got.Error != test.want.Error {
+			t.Errorf("reply to %v = %v; got %v", test.msg, test.want, got)
+		}
+	}
+
+	// The order is acknowledged and the new quantities are broadcasted, in
+	// any order. Who ordered is only sent to the staff.
+	if err := conn.WriteMessage(websocket.TextMessage, []byte(order)); err != nil {
+		t.Fatalf("conn.WriteMessage() failed: %v", err)
+	}
+	var lastID uint64
+	for i := 0; i < 2; i++ {
+		var msg wsMessage
+		if err := conn.ReadJSON(&msg); err != nil {
+			t.Fatalf("conn.ReadJSON() failed: %v", err)
+		}
+
+		switch msg.Type {
+		case "ack":
+			var data struct{ OrderID uint }
+			json.Unmarshal(msg.Data, &data)
+			if msg.Ref != "a" || data.OrderID != 1 {
+				t.Errorf("ack = {ref: a, orderId: 1}; got %v", msg)
+			}
+		case "update":
+			lastID = msg.ID
+			if want := `{"version":1,"previous":0,"beers":[{"id":1,"totalSoldQuantity":2}]}`; string(msg.Data) != want {
+				t.Errorf("update event = %v; got %v", want, string(msg.Data))
+			}
+		default:
+			t.Errorf("unexpected message %v", msg)
+		}
+	}
+
+	// Snapshots are stamped with the last event's ID, so that clients can
+	// resume from them.
+	if got := send(`{"type": "snapshot", "ref": "g"}`); got.Type != "snapshot" || got.ID != lastID {
+		t.Errorf("snapshot ID = %v; got %v (%v)", lastID, got.ID, got.Type)
+	}
+
+	want := `[{"orderId":1,"userId":1,"userName":"bob","id":1,"orderedQuantity":2}]`
+	if e := <-staff; e.Type != "order" || e.Payload() != want {
+		t.Errorf("staff event = order %v; got %v %v", want, e.Type, e.Payload())
+	}
+}